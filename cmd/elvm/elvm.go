@@ -8,6 +8,9 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,19 +23,148 @@ import (
 
 const (
 	defaultDefaultFs = "xfs"
+	defaultDeviceClass = "default"
+	defaultGcTtl = time.Hour
+	defaultOverprovisionRatio = 1.0
 
 	version = "0.1.0"
 )
 
+// Log levels, from most to least verbose
+const (
+	logLevelInfo int32 = iota
+	logLevelWarn
+	logLevelError
+)
+
+var logLevels = map[string]int32 {
+	"info": logLevelInfo,
+	"warn": logLevelWarn,
+	"error": logLevelError,
+}
+
 type logWriter struct {
+	// Accessed atomically, since it can change on reload
+	level int32
+}
+
+// Collects repeated `--device-class name=vg[,vg...]` flags
+// Note: Repeating a class adds more volume groups to it
+type deviceClassFlag map[string][]string
+
+func (classes deviceClassFlag) String() string {
+	pairs := []string{}
+	for class, volumeGroups := range classes {
+		pairs = append(pairs, class + "=" + strings.Join(volumeGroups, ","))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (classes deviceClassFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("expected name=vg[,vg...], got '%s'", value)
+	}
+
+	for _, volumeGroup := range strings.Split(parts[1], ",") {
+		if len(volumeGroup) == 0 {
+			return fmt.Errorf("empty volume group in '%s'", value)
+		}
+
+		if classes.has(parts[0], volumeGroup) {
+			return fmt.Errorf("volume group '%s' specified more than once for device class '%s'", volumeGroup, parts[0])
+		}
+
+		classes[parts[0]] = append(classes[parts[0]], volumeGroup)
+	}
+
+	return nil
+}
+
+func (classes deviceClassFlag) toConfig(defaultDeviceClass string) *elvm.Config {
+	config := &elvm.Config{
+		DefaultDeviceClass: defaultDeviceClass,
+	}
+
+	names := []string{}
+	for class := range classes {
+		names = append(names, class)
+	}
+	sort.Strings(names)
+
+	for _, class := range names {
+		config.DeviceClasses = append(config.DeviceClasses, &elvm.DeviceClassConfig{
+			Name: class,
+			VolumeGroups: classes[class],
+		})
+	}
+
+	return config
+}
+
+func (classes deviceClassFlag) has(class string, volumeGroup string) bool {
+	for _, existing := range classes[class] {
+		if existing == volumeGroup {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (writer logWriter) Write(bytes []byte) (int, error) {
+func (writer *logWriter) Write(bytes []byte) (int, error) {
+	if !writer.shouldWrite(string(bytes)) {
+		return len(bytes), nil
+	}
+
 	return fmt.Print(time.Now().UTC().Format("2006-01-02T15:04:05.999Z") + " - " + string(bytes))
 }
 
+// Lines are tagged with their level, like [INFO]. Untagged lines are always written.
+func (writer *logWriter) shouldWrite(line string) bool {
+	level := atomic.LoadInt32(&writer.level)
+	switch {
+	case strings.HasPrefix(line, "[INFO]"), strings.HasPrefix(line, "[ACCESS]"):
+		return level <= logLevelInfo
+	case strings.HasPrefix(line, "[WARN]"):
+		return level <= logLevelWarn
+	}
+
+	return true
+}
+
+func (writer *logWriter) setLevel(name string) error {
+	level, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level '%s'", name)
+	}
+
+	atomic.StoreInt32(&writer.level, level)
+	return nil
+}
+
+// Reloads the configuration on SIGHUP, keeping the old one if that fails
+func reloadHandler(reload func() error) {
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel, syscall.SIGHUP)
+
+	go func() {
+		for range channel {
+			log.Println("SIGHUP received. Reloading configuration...")
+			if err := reload(); err != nil {
+				log.Println("[ERROR] Could not reload configuration. Keeping the current one:", err.Error())
+				continue
+			}
+
+			log.Println("Configuration reloaded.")
+		}
+	}()
+}
+
 func killHandler(server *grpc.Server) {
-	channel := make(chan os.Signal)
+	channel := make(chan os.Signal, 1)
 	signal.Notify(channel, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
@@ -47,22 +179,40 @@ func killHandler(server *grpc.Server) {
 func main() {
 	// Set up custom logging
 	log.SetFlags(0)
-	log.SetOutput(new(logWriter))
+	writer := new(logWriter)
+	log.SetOutput(writer)
 	log.Println("Starting ephemeral LVM CSI plugin version", version)
 
 	// Get command arguments
+	deviceClassesFlag := deviceClassFlag{}
+	flag.Var(deviceClassesFlag, "device-class", "A device class and the volume groups backing it, as name=vg[,vg...]. Can be repeated.")
+	configFlag := flag.String("config", "", "Path to a YAML or JSON file defining the device classes. Replaces device-class and volume-group.")
+	allowMultiNodeFlag := flag.Bool("allow-multi-node", false, "Allows multi-node access modes for new volumes, even though volumes only exist on a single node. Existing MULTI_NODE_MULTI_WRITER volumes can always be used.")
+	defaultDeviceClassFlag := flag.String("default-device-class", defaultDeviceClass, "Device class to use when a StorageClass does not specify one.")
+	logLevelFlag := flag.String("log-level", "info", "Least severe messages to log: info, warn or error.")
 	fsTypeFlag := flag.String("default-fs", defaultDefaultFs, "Default filesystem to use when formatting.")
+	gcDryRunFlag := flag.Bool("gc-dry-run", false, "Only reports orphaned inline volumes instead of removing them.")
+	gcIntervalFlag := flag.Duration("gc-interval", 0, "How often to look for orphaned volumes, starting at launch. Only inline volumes are removed, the rest are reported. Disabled when 0.")
+	gcTtlFlag := flag.Duration("gc-ttl", defaultGcTtl, "How long a volume must go unused before it counts as orphaned.")
+	minimumVolumeSizeFlag := flag.Uint64("min-volume-size", 0, "Smallest size, in bytes, of any created volume.")
 	nodeIdFlag := flag.String("node-id", "", "ID of the node running the plugin.")
+	overprovisionRatioFlag := flag.Float64("overprovision-ratio", defaultOverprovisionRatio, "How many times the real size of a thin pool can be handed out to thin volumes.")
 	overwriteSocketFlag := flag.Bool("overwrite-socket", false, "Overwrites the unix socket, if it exists already.")
+	placementPolicyFlag := flag.String("placement-policy", elvm.PLACEMENT_MOST_FREE, "How to choose between the volume groups of a device class: most-free, least-used, round-robin or binpack.")
+	previousBootFlag := flag.String("previous-boot-volumes", elvm.PREVIOUS_BOOT_KEEP, "What to do with volumes created before the node last booted: keep, delete (at launch) or refuse (to stage them).")
+	reserveFlag := flag.Uint64("reserve", 0, "Space, in bytes, to always keep free in each volume group or thin pool.")
+	sanitizeFlag := flag.String("sanitize", elvm.SANITIZE_NONE, "How to clear old data from thick volumes: none, wipefs, discard or zero.")
+	sanitizeOnFlag := flag.String("sanitize-on", elvm.SANITIZE_ON_DELETE, "When to sanitize volumes: delete or create.")
+	thinPoolFlag := flag.String("thin-pool", "", "Name of the thin pool in the volume group to create thin volumes in by default.")
 	unixSocketFlag := flag.String("unix-socket-path", "/tmp/csi.sock", "Path to the listening unix socket.")
-	volumeGroupFlag := flag.String("volume-group", "", "The name of the volume group to use.")
+	volumeGroupFlag := flag.String("volume-group", "", "The name of the volume group backing the default device class.")
 	flag.Parse()
 
 	// Make sure that required flags are non-empty
 	requireNotEmpty := map[string]string {
+		"defaultDeviceClass": *defaultDeviceClassFlag,
 		"fsType": *fsTypeFlag,
 		"nodeId": *nodeIdFlag,
-		"volumeGroup": *volumeGroupFlag,
 	}
 	for flag, value := range requireNotEmpty {
 		if len(value) == 0 {
@@ -70,6 +220,55 @@ func main() {
 		}
 	}
 
+	// Reads the config file, falling back to the flags for anything it leaves out
+	loadConfig := func() (*elvm.Config, error) {
+		config, err := elvm.LoadConfig(*configFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(config.DefaultDeviceClass) == 0 {
+			config.DefaultDeviceClass = *defaultDeviceClassFlag
+		}
+
+		if len(config.LogLevel) == 0 {
+			config.LogLevel = *logLevelFlag
+		}
+
+		if _, ok := logLevels[config.LogLevel]; !ok {
+			return nil, fmt.Errorf("unknown log level '%s'", config.LogLevel)
+		}
+
+		return config, nil
+	}
+
+	// Device classes come from either the config file or the flags, never both
+	var config *elvm.Config
+	if len(*configFlag) != 0 {
+		if len(deviceClassesFlag) != 0 || len(*volumeGroupFlag) != 0 {
+			log.Fatalln("[ERROR] config cannot be combined with deviceClass or volumeGroup!")
+		}
+
+		loaded, err := loadConfig()
+		if err != nil {
+			log.Fatalln("[ERROR]", err.Error())
+		}
+
+		config = loaded
+	} else {
+		// The plain volume group flag is shorthand for the default device class
+		if len(*volumeGroupFlag) != 0 && !deviceClassesFlag.has(*defaultDeviceClassFlag, *volumeGroupFlag) {
+			deviceClassesFlag[*defaultDeviceClassFlag] = append(deviceClassesFlag[*defaultDeviceClassFlag], *volumeGroupFlag)
+		}
+
+		config = deviceClassesFlag.toConfig(*defaultDeviceClassFlag)
+		config.LogLevel = *logLevelFlag
+	}
+
+	if err := writer.setLevel(config.LogLevel); err != nil {
+		log.Fatalln("[ERROR]", err.Error())
+	}
+
 	// Remove the socket file, if specified
 	if *overwriteSocketFlag {
 		os.Remove(*unixSocketFlag)
@@ -84,12 +283,61 @@ func main() {
 	log.Println("Got the following configuration...")
 	log.Println("\tNode ID:", *nodeIdFlag)
 	log.Println("\tUnix Socket path:", *unixSocketFlag)
-	log.Println("\tVolume Group:", *volumeGroupFlag)
+	log.Println("\tConfig File:", *configFlag)
+	for _, class := range config.DeviceClasses {
+		log.Println(fmt.Sprintf("\tDevice Class '%s': %v", class.Name, class.VolumeGroups))
+	}
+	log.Println("\tDefault Device Class:", config.DefaultDeviceClass)
+	log.Println("\tDefault FS:", *fsTypeFlag)
+	log.Println("\tLog Level:", config.LogLevel)
+	log.Println("\tPlacement Policy:", *placementPolicyFlag)
+	log.Println("\tThin Pool:", *thinPoolFlag)
+	log.Println("\tOverprovision Ratio:", *overprovisionRatioFlag)
+	log.Println("\tAllow Multi-Node:", *allowMultiNodeFlag)
+	log.Println("\tReserve:", *reserveFlag)
+	log.Println("\tPrevious Boot Volumes:", *previousBootFlag)
+	log.Println("\tSanitize:", *sanitizeFlag, "on", *sanitizeOnFlag)
+	log.Println("\tMinimum Volume Size:", *minimumVolumeSizeFlag)
+	log.Println("\tGC Interval:", *gcIntervalFlag)
+	log.Println("\tGC TTL:", *gcTtlFlag)
+	log.Println("\tGC Dry Run:", *gcDryRunFlag)
+
+	// Set up the CSI endpoints
+	// Note: This validates the whole configuration, so do it before anything is
+	// created on disk
+	elvmServer := elvm.NewELVMServer()
+	identity, controller, node, err := elvmServer.GetCSIEndpoints(&elvm.ELVMArgs{
+		AllowMultiNode: *allowMultiNodeFlag,
+		Config: config,
+		FsType: *fsTypeFlag,
+		GarbageCollectionInterval: *gcIntervalFlag,
+		GarbageCollectionTTL: *gcTtlFlag,
+		GarbageCollectionDryRun: *gcDryRunFlag,
+		MinimumVolumeSize: *minimumVolumeSizeFlag,
+		NodeId: *nodeIdFlag,
+		OverprovisionRatio: *overprovisionRatioFlag,
+		PlacementPolicy: *placementPolicyFlag,
+		PreviousBootPolicy: *previousBootFlag,
+		Reserve: *reserveFlag,
+		Sanitize: *sanitizeFlag,
+		SanitizeOn: *sanitizeOnFlag,
+		ThinPool: *thinPoolFlag,
+	})
+	if err != nil {
+		log.Fatalln("[ERROR]", err.Error())
+	}
+
+	// Get rid of any data that should not have survived a reboot before anything
+	// can ask for it
+	elvmServer.RemovePreviousBootVolumes(context.Background())
+
+	// Finish sanitizing anything that was cut short by the last shutdown
+	elvmServer.ResumeSanitization(context.Background())
 
 	// Setup socket listener
 	socket, err := net.Listen("unix", *unixSocketFlag)
 	if err != nil {
-		log.Fatalf("[ERROR] Failed to set up unix socket listener:", err)
+		log.Fatalln("[ERROR] Failed to set up unix socket listener:", err)
 	}
 
 	// Delete the socket listener when we finish
@@ -103,9 +351,9 @@ func main() {
 		// Run the method
 		resp, err := handler(ctx, request)
 
-		// Log any errors
+		// Log any errors, leaving it to the CO to retry
 		if err != nil {
-			log.Fatalln("[ACCESS ERR]", info.FullMethod, err.Error())
+			log.Println("[ACCESS ERR]", info.FullMethod, err.Error())
 		}
 
 		// Pass the response on
@@ -114,14 +362,8 @@ func main() {
 
 	// Setup server
 	server := grpc.NewServer(grpc.UnaryInterceptor(requestInterceptor))
-	elvmServer := elvm.NewELVMServer()
 
 	// Register the CSI endpoints
-	identity, controller, node := elvmServer.GetCSIEndpoints(&elvm.ELVMArgs{
-		FsType: *fsTypeFlag,
-		NodeId: *nodeIdFlag,
-		VolumeGroup: *volumeGroupFlag,
-	})
 
 	csi.RegisterIdentityServer(server, identity)
 	csi.RegisterControllerServer(server, controller)
@@ -130,8 +372,30 @@ func main() {
 	// Set up kill handler
 	killHandler(server)
 
+	// Set up reload handler
+	// Note: Only the config file can be reloaded, since flags can't change
+	reloadHandler(func() error {
+		if len(*configFlag) == 0 {
+			return fmt.Errorf("no config file was given")
+		}
+
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		if err := elvmServer.Reload(config); err != nil {
+			return err
+		}
+
+		return writer.setLevel(config.LogLevel)
+	})
+
+	// Clean up after crashes in the background
+	go elvmServer.RunGarbageCollector(context.Background())
+
 	// Start serving
 	if err := server.Serve(socket); err != nil {
-		log.Fatalf("[ERROR] Failed to serve =>", err)
+		log.Fatalln("[ERROR] Failed to serve =>", err)
 	}
 }
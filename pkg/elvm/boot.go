@@ -0,0 +1,125 @@
+package elvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/google/lvmd/parser"
+)
+
+// What to do with volumes created before the node last booted
+const (
+	// Use them like any other volume
+	PREVIOUS_BOOT_KEEP = "keep"
+	// Remove them when the driver starts, and refuse to use any that remain
+	PREVIOUS_BOOT_DELETE = "delete"
+	// Leave them on disk, but refuse to use them
+	PREVIOUS_BOOT_REFUSE = "refuse"
+)
+
+var SUPPORTED_PREVIOUS_BOOT_POLICIES = []string{
+	PREVIOUS_BOOT_KEEP,
+	PREVIOUS_BOOT_DELETE,
+	PREVIOUS_BOOT_REFUSE,
+}
+
+// Changes every time the kernel boots
+const BOOT_ID_PATH = "/proc/sys/kernel/random/boot_id"
+
+func isPreviousBootPolicySupported(policy string) bool {
+	for _, supported := range SUPPORTED_PREVIOUS_BOOT_POLICIES {
+		if policy == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getBootId() (string, error) {
+	contents, err := ioutil.ReadFile(BOOT_ID_PATH)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not read boot ID: %s", err.Error()))
+	}
+
+	bootId := strings.TrimSpace(string(contents))
+	if bootId == "" {
+		return "", errors.New(fmt.Sprintf("Boot ID in '%s' is empty", BOOT_ID_PATH))
+	}
+
+	return bootId, nil
+}
+
+// Note: Volumes without a boot ID predate it being recorded, so they can only be
+// from an earlier boot.
+func isFromPreviousBoot(logicalVolume *parser.LV, bootId string) bool {
+	volumeBootId, ok := getTagValue(logicalVolume.Tags, ELVM_BOOT_TAG_PREFIX)
+	return !ok || volumeBootId != bootId
+}
+
+// Removes every volume and snapshot that was created before the node last
+// booted, if enabled. Volumes that are somehow in use are left alone.
+func (server *ELVM) RemovePreviousBootVolumes(ctx context.Context) {
+	if server.args == nil || server.args.PreviousBootPolicy != PREVIOUS_BOOT_DELETE {
+		return
+	}
+
+	for _, vg := range server.deviceClasses.get().getAllVolumeGroups() {
+		lvs, err := getCurrentLVs(ctx, vg)
+		if err != nil {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Could not list logical volumes of '%s' to remove those from earlier boots: %s",
+					vg.Name,
+					err.Error(),
+				),
+			)
+			continue
+		}
+
+		// Snapshots go first, since removing an origin would take them with it
+		stale := []*parser.LV{}
+		for _, tag := range []string{ELVM_SNAPSHOT_TAG, ELVM_TAG} {
+			for _, lv := range lvs {
+				if hasTag(lv.Tags, tag) && isFromPreviousBoot(lv, server.bootId) {
+					stale = append(stale, lv)
+				}
+			}
+		}
+
+		for _, lv := range stale {
+			if lv.Attributes.Open == parser.VolumeOpenIsOpen {
+				log.Println(
+					fmt.Sprintf(
+						"[WARN] Keeping volume '%s' from an earlier boot, since it is in use",
+						getVolumeId(lv),
+					),
+				)
+				continue
+			}
+
+			log.Println(
+				fmt.Sprintf(
+					"[INFO] Removing volume '%s' from an earlier boot",
+					getVolumeId(lv),
+				),
+			)
+
+			policy := getRemovalSanitizePolicy(server.deviceClasses.get(), lv)
+			if output, err := server.sanitizer.remove(ctx, lv, policy); err != nil {
+				log.Println(
+					fmt.Sprintf(
+						"[WARN] Could not remove volume '%s' from an earlier boot: %s | %s",
+						getVolumeId(lv),
+						output,
+						err.Error(),
+					),
+				)
+			}
+		}
+	}
+}
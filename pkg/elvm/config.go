@@ -0,0 +1,67 @@
+package elvm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration of the device classes, as read from a YAML or JSON file
+// Note: JSON is valid YAML, so both are read by the same parser.
+type Config struct {
+	// Class used when a StorageClass does not name one
+	DefaultDeviceClass string `yaml:"defaultDeviceClass"`
+	// Settings of any class that does not set its own
+	PlacementPolicy string `yaml:"placementPolicy"`
+	FsType string `yaml:"fsType"`
+	Reserve *uint64 `yaml:"reserve"`
+	Sanitize string `yaml:"sanitize"`
+	SanitizeOn string `yaml:"sanitizeOn"`
+	// One of info, warn or error. Only applied by the command.
+	LogLevel string `yaml:"logLevel"`
+	DeviceClasses []*DeviceClassConfig `yaml:"deviceClasses"`
+}
+
+// A single device class. Anything left unset is taken from the top level of the
+// config, then from the command line.
+type DeviceClassConfig struct {
+	Name string `yaml:"name"`
+	VolumeGroups []string `yaml:"volumeGroups"`
+	PlacementPolicy string `yaml:"placementPolicy"`
+	ThinPool string `yaml:"thinPool"`
+	FsType string `yaml:"fsType"`
+	// Extra arguments given to mkfs when formatting
+	MkfsOptions []string `yaml:"mkfsOptions"`
+	// Options used when mounting, on top of any requested by the CO
+	MountOptions []string `yaml:"mountOptions"`
+	// Number of PVs to stripe thick volumes across, and the size of each stripe
+	// in bytes
+	Stripes uint32 `yaml:"stripes"`
+	StripeSize uint64 `yaml:"stripeSize"`
+	// Space, in bytes, to always keep free in each volume group or thin pool
+	Reserve *uint64 `yaml:"reserve"`
+	// Names of the CSI access modes allowed for volumes of this class, such as
+	// SINGLE_NODE_WRITER. All supported modes are allowed when empty.
+	AccessModes []string `yaml:"accessModes"`
+	// How to clear old data from thick volumes (none, wipefs, discard or zero),
+	// and whether to do so on delete or on create
+	Sanitize string `yaml:"sanitize"`
+	SanitizeOn string `yaml:"sanitizeOn"`
+}
+
+// Reads a config file, rejecting any unknown fields
+func LoadConfig(path string) (*Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read config file '%s': %s", path, err.Error()))
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(contents, config); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not parse config file '%s': %s", path, err.Error()))
+	}
+
+	return config, nil
+}
@@ -2,11 +2,17 @@ package elvm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
+	"sort"
+	"strconv"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/google/lvmd/commands"
 	"github.com/google/lvmd/parser"
 
@@ -15,136 +21,1270 @@ import (
 )
 
 type elvmControllerServer struct {
-	volumeGroup *parser.VG
+	deviceClasses *deviceClassStore
+	overprovisionRatio float64
+	allowMultiNode bool
+	nodeId string
+	minimumVolumeSize uint64
+	bootId string
+	sanitizer *sanitizer
 }
 
 func (server *elvmControllerServer) ControllerExpandVolume(ctx context.Context, request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	log.Println("CONTROLLER: EXPAND_VOLUME")
-	return nil, nil
+	// Make sure that we have a valid ID to expand
+	if len(request.VolumeId) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerExpandVolume Volume ID must be provided.",
+		)
+	}
+
+	// Make sure that the size is valid
+	if request.CapacityRange == nil || request.CapacityRange.RequiredBytes < 0 || request.CapacityRange.LimitBytes < 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerExpandVolume CapacityRange must be provided.",
+		)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not find requested logical volume: %s", err.Error()),
+		)
+	}
+
+	vg, err := getCurrentVG(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not get selected volume group: %s", err.Error()),
+		)
+	}
+
+	// Get all of the logical volumes
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Make sure that the requested volume exists
+	logicalVolume := findLogicalVolume(lvs, volumeName)
+	if logicalVolume == nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not find requested logical volume: %s", request.VolumeId),
+		)
+	}
+
+	// Make sure that the volume is managed by ELVM
+	if !hasTag(logicalVolume.Tags, ELVM_TAG) {
+		return nil, status.Error(
+			codes.Aborted,
+			"[ERROR] ControllerExpandVolume Found volume to expand but it is not managed by ELVM. Aborting.",
+		)
+	}
+
+	// Only filesystems need to be grown on the node after the LV has been extended
+	// Note: Encrypted volumes always do, even in block mode, since their mapping
+	// on the node has to grow along with the LV.
+	isBlock := request.VolumeCapability != nil && request.VolumeCapability.GetBlock() != nil
+	unformatted := false
+	if info, err := getVolumeInfo(logicalVolume); err == nil {
+		unformatted = info.FsType == ""
+	}
+	nodeExpansionRequired := isEncrypted(logicalVolume) || !(isBlock || unformatted)
+
+	// If the volume is already large enough, then there is nothing to do
+	// Note: The spec says that this should pass
+	// https://github.com/container-storage-interface/spec/blob/master/spec.md#controllerexpandvolume
+	required := uint64(request.CapacityRange.RequiredBytes)
+	if required <= logicalVolume.Size {
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes: int64(logicalVolume.Size),
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
+
+	// The volume can grow into whatever it has plus whatever is free in the VG
+	// Note: Thin volumes grow into their pool instead
+	class, err := server.deviceClasses.get().getDeviceClassOfVolume(logicalVolume)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not find device class of volume: %s", err.Error()),
+		)
+	}
+
+	thinPool, _ := getTagValue(logicalVolume.Tags, ELVM_POOL_TAG_PREFIX)
+	free, err := server.getAvailableCapacity(ctx, vg, thinPool, class.reserve)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not get available capacity for volume: %s", err.Error()),
+		)
+	}
+
+	available := logicalVolume.Size + free
+	if required > available {
+		return nil, status.Error(
+			codes.ResourceExhausted,
+			fmt.Sprintf(
+				"[ERROR] ControllerExpandVolume Not enough space available for request. Requested (%d) > Available (%d)",
+				required,
+				available,
+			),
+		)
+	}
+
+	var capacity uint64
+	if thinPool != "" {
+		capacity, err = getThinCapacity(available, required, uint64(request.CapacityRange.LimitBytes))
+	} else {
+		capacity, err = getCapacity(available, required, uint64(request.CapacityRange.LimitBytes))
+	}
+
+	if err != nil {
+		return nil, status.Error(
+			codes.OutOfRange,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Requested capacity cannot be allocated: %s", err.Error()),
+		)
+	}
+
+	// LVM will round up to the extent size on its own, so do it here to make
+	// sure that we still fit within the requested range
+	extentSize, err := getExtentSize(ctx, vg)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not get extent size of volume group: %s", err.Error()),
+		)
+	}
+
+	capacity, err = alignToExtent(capacity, extentSize, required, uint64(request.CapacityRange.LimitBytes), available)
+	if err != nil {
+		return nil, status.Error(
+			codes.OutOfRange,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Requested capacity cannot be allocated: %s", err.Error()),
+		)
+	}
+
+	log.Println(
+		fmt.Sprintf(
+			"[INFO] Expanding logical volume '%s' from %d to %d",
+			logicalVolume.Name,
+			logicalVolume.Size,
+			capacity,
+		),
+	)
+
+	// Actually extend the volume
+	if err := extendLogicalVolume(ctx, logicalVolume, capacity); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerExpandVolume Could not extend logical volume: %s", err.Error()),
+		)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes: int64(capacity),
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
+}
+
+func (server *elvmControllerServer) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	// Make sure that we have a volume ID
+	if len(request.VolumeId) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerGetVolume Volume ID must be provided.",
+		)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerGetVolume Could not find requested logical volume: %s", err.Error()),
+		)
+	}
+
+	// Get all of the logical volumes
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerGetVolume Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Make sure that the volume exists and is managed by ELVM
+	logicalVolume := findLogicalVolume(lvs, volumeName)
+	if logicalVolume == nil || !hasTag(logicalVolume.Tags, ELVM_TAG) {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerGetVolume Could not find requested ELVM volume: %s", request.VolumeId),
+		)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: server.toCSIVolume(logicalVolume),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: server.getPublishedNodeIds(logicalVolume),
+			VolumeCondition: getVolumeCondition(logicalVolume, lvs),
+		},
+	}, nil
+}
+
+func (server *elvmControllerServer) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	// Make sure that we have a name
+	if len(request.Name) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerCreateSnapshot Name must be provided.",
+		)
+	}
+
+	// Make sure that we have a source volume
+	if len(request.SourceVolumeId) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerCreateSnapshot Source volume ID must be provided.",
+		)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, originName, err := server.deviceClasses.get().resolveVolumeId(request.SourceVolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Could not find requested source logical volume: %s", err.Error()),
+		)
+	}
+
+	vg, err := getCurrentVG(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Could not get selected volume group: %s", err.Error()),
+		)
+	}
+
+	// Get all of the logical volumes
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Make sure that the source volume exists and is managed by ELVM
+	origin := findLogicalVolume(lvs, originName)
+	if origin == nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Could not find source logical volume: %s", request.SourceVolumeId),
+		)
+	}
+
+	if !hasTag(origin.Tags, ELVM_TAG) {
+		return nil, status.Error(
+			codes.Aborted,
+			"[ERROR] ControllerCreateSnapshot Found volume to snapshot but it is not managed by ELVM. Aborting.",
+		)
+	}
+
+	// The key of an ephemeral volume is lost once it is unstaged, so a snapshot
+	// of one could never be read
+	if getEncryption(origin) == ENCRYPTION_EPHEMERAL {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Volumes with ephemeral encryption cannot be snapshotted: %s", request.SourceVolumeId),
+		)
+	}
+
+	// Generate a unique name with the following format: elvm-snap-HASH
+	// Note: HASH is the fnv hash of the name
+	hasher := fnv.New64a()
+	hasher.Write([]byte(request.Name))
+	snapshotName := fmt.Sprintf("elvm-snap-%d", hasher.Sum64())
+
+	// If the snapshot exists already for the same source, then report it
+	// Note: The spec says that this should pass
+	// https://github.com/container-storage-interface/spec/blob/master/spec.md#createsnapshot
+	if existing := findLogicalVolume(lvs, snapshotName); existing != nil {
+		source, _ := getTagValue(existing.Tags, ELVM_SOURCE_TAG_PREFIX)
+		if !hasTag(existing.Tags, ELVM_SNAPSHOT_TAG) || source != origin.Name {
+			return nil, status.Error(
+				codes.AlreadyExists,
+				fmt.Sprintf("[ERROR] ControllerCreateSnapshot Snapshot exists already with a different source: %s", existing.Name),
+			)
+		}
+
+		return &csi.CreateSnapshotResponse{
+			Snapshot: toCSISnapshot(existing),
+		}, nil
+	}
+
+	// Figure out how much space to reserve for changes to the origin
+	cowSize, err := getSnapshotCowSize(origin, request.Parameters[SNAPSHOT_PARAM_COW_SIZE])
+	if err != nil {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Invalid parameter '%s': %s", SNAPSHOT_PARAM_COW_SIZE, err.Error()),
+		)
+	}
+
+	if origin.Attributes.Type != parser.VolumeTypeThin && cowSize > vg.FreeSize {
+		return nil, status.Error(
+			codes.ResourceExhausted,
+			fmt.Sprintf(
+				"[ERROR] ControllerCreateSnapshot Not enough space available for snapshot. Requested (%d) > Available (%d)",
+				cowSize,
+				vg.FreeSize,
+			),
+		)
+	}
+
+	// Create some unique tags to show ownership
+	tags := []string{
+		ELVM_SNAPSHOT_TAG,
+		ELVM_NAME_TAG_PREFIX + request.Name,
+		ELVM_SOURCE_TAG_PREFIX + origin.Name,
+		fmt.Sprintf("%s%d", ELVM_ORIGIN_SIZE_TAG_PREFIX, origin.Size),
+		fmt.Sprintf("%s%d", ELVM_CREATED_TAG_PREFIX, time.Now().Unix()),
+	}
+
+	// Thin snapshots live in the same pool as their origin
+	if thinPool, ok := getTagValue(origin.Tags, ELVM_POOL_TAG_PREFIX); ok {
+		tags = append(tags, ELVM_POOL_TAG_PREFIX + thinPool)
+	}
+
+	// Snapshots hold the same encrypted data as their origin
+	if encryption, ok := getTagValue(origin.Tags, ELVM_ENCRYPTION_TAG_PREFIX); ok {
+		tags = append(tags, ELVM_ENCRYPTION_TAG_PREFIX + encryption)
+	}
+
+	if server.bootId != "" {
+		tags = append(tags, ELVM_BOOT_TAG_PREFIX + server.bootId)
+	}
+
+	// Actually create the snapshot
+	if err := createSnapshot(ctx, origin, snapshotName, cowSize, tags); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Could not create snapshot: %s", err.Error()),
+		)
+	}
+
+	// Fetch the snapshot again so that we report what LVM actually made
+	lvs, err = getCurrentLVs(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	snapshot := findLogicalVolume(lvs, snapshotName)
+	if snapshot == nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateSnapshot Could not find newly created snapshot: %s", snapshotName),
+		)
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: toCSISnapshot(snapshot),
+	}, nil
+}
+
+func (server *elvmControllerServer) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	// Make sure that we have a valid ID to delete
+	if len(request.SnapshotId) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerDeleteSnapshot Snapshot ID must be provided.",
+		)
+	}
+
+	// Find the volume group that holds the snapshot
+	// Note: The spec says that missing snapshots should pass
+	volumeGroup, snapshotName, err := server.deviceClasses.get().resolveVolumeId(request.SnapshotId)
+	if err != nil {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	// Get all of the logical volumes
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerDeleteSnapshot Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// If the snapshot does not exist, then there is nothing to do
+	// Note: The spec says that this should pass
+	// https://github.com/container-storage-interface/spec/blob/master/spec.md#deletesnapshot
+	snapshot := findLogicalVolume(lvs, snapshotName)
+	if snapshot == nil {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	// Make sure that the snapshot is managed by ELVM
+	if !hasTag(snapshot.Tags, ELVM_SNAPSHOT_TAG) {
+		return nil, status.Error(
+			codes.Aborted,
+			"[ERROR] ControllerDeleteSnapshot Found snapshot to delete but it is not managed by ELVM. Aborting.",
+		)
+	}
+
+	// Actually delete the snapshot
+	output, err := commands.RemoveLV(ctx, volumeGroup.Name, snapshot.Name)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] ControllerDeleteSnapshot Could not delete snapshot: %s | %s",
+				output,
+				err.Error(),
+			),
+		)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (server *elvmControllerServer) ListSnapshots(ctx context.Context, request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	// Make sure that the page size is valid
+	if request.MaxEntries < 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerListSnapshots Max entries cannot be negative.",
+		)
+	}
+
+	// Get all of the logical volumes
+	lvs, err := server.getAllLVs(ctx)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerListSnapshots Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Filter out everything that isn't a matching ELVM snapshot
+	// Note: IDs that can't be resolved can't match anything
+	snapshotId := server.normalizeVolumeId(request.SnapshotId)
+	sourceVolumeId := server.normalizeVolumeId(request.SourceVolumeId)
+	snapshots := []*parser.LV{}
+	for _, lv := range lvs {
+		if !hasTag(lv.Tags, ELVM_SNAPSHOT_TAG) {
+			continue
+		}
+
+		snapshot := toCSISnapshot(lv)
+		if request.SnapshotId != "" && snapshot.SnapshotId != snapshotId {
+			continue
+		}
+
+		if request.SourceVolumeId != "" && snapshot.SourceVolumeId != sourceVolumeId {
+			continue
+		}
+
+		snapshots = append(snapshots, lv)
+	}
+
+	page, nextToken, err := getPage(snapshots, request.MaxEntries, request.StartingToken)
+	if err != nil {
+		return nil, status.Error(
+			codes.Aborted,
+			fmt.Sprintf("[ERROR] ControllerListSnapshots %s", err.Error()),
+		)
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, snapshot := range page {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: toCSISnapshot(snapshot),
+		})
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries: entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// Convert an ELVM snapshot into its CSI representation
+// Note: LVM reports the size of the COW area for thick snapshots, so the size of
+// the origin is recorded separately. That is the minimum size needed to restore it.
+func toCSISnapshot(snapshot *parser.LV) *csi.Snapshot {
+	// Note: Snapshots are always in the same VG as their source
+	source, _ := getTagValue(snapshot.Tags, ELVM_SOURCE_TAG_PREFIX)
+
+	var created int64
+	if value, ok := getTagValue(snapshot.Tags, ELVM_CREATED_TAG_PREFIX); ok {
+		created, _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	// Invalidated snapshots have overflowed their COW space and are useless
+	state := snapshot.Attributes.State
+	readyToUse := state != parser.VolumeStateInvalidSnapshot && state != parser.VolumeStateInvalidSuspendedSnapshot
+
+	return &csi.Snapshot{
+		SizeBytes: int64(getSnapshotOriginSize(snapshot)),
+		SnapshotId: getVolumeId(snapshot),
+		SourceVolumeId: getVolumeId(&parser.LV{
+			Name: source,
+			VGName: snapshot.VGName,
+		}),
+		CreationTime: &timestamp.Timestamp{
+			Seconds: created,
+		},
+		ReadyToUse: readyToUse,
+	}
+}
+
+func (server *elvmControllerServer) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	// Make sure that we have a name
+	if len(request.Name) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerCreateVolume Name must be provided.",
+		)
+	}
+
+	// Make sure that we have been given capabilities that we support
+	if len(request.VolumeCapabilities) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerCreateVolume Volume capabilities must be provided.",
+		)
+	}
+
+	for _, capability := range request.VolumeCapabilities {
+		if err := checkVolumeCapability(capability, server.allowMultiNode); err != nil {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume %s", err.Error()),
+			)
+		}
+	}
+
+	// Make sure that the size is valid
+	if request.CapacityRange == nil || request.CapacityRange.RequiredBytes < 0 || request.CapacityRange.LimitBytes < 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerCreateVolume CapacityRange must be provided.",
+		)
+	}
+
+	// Volumes only ever exist on this node, so it must be an allowed topology
+	// Note: Preferred topologies are only checked when nothing is required
+	if requirements := request.AccessibilityRequirements; requirements != nil {
+		candidates := requirements.Requisite
+		if len(candidates) == 0 {
+			candidates = requirements.Preferred
+		}
+
+		accessible := len(candidates) == 0
+		for _, topology := range candidates {
+			if isTopologyForNode(topology, server.nodeId) {
+				accessible = true
+				break
+			}
+		}
+
+		if !accessible {
+			return nil, status.Error(
+				codes.ResourceExhausted,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Accessibility requirements do not include this node: %s", server.nodeId),
+			)
+		}
+	}
+
+	// Find the requested device class
+	class, err := server.deviceClasses.get().getDeviceClass(request.Parameters[VOLUME_PARAM_DEVICE_CLASS])
+	if err != nil {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf("[ERROR] ControllerCreateVolume Invalid parameter '%s': %s", VOLUME_PARAM_DEVICE_CLASS, err.Error()),
+		)
+	}
+
+	// The class might allow fewer access modes than ELVM does
+	for _, capability := range request.VolumeCapabilities {
+		if !class.allowsAccessMode(capability.AccessMode.Mode) {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Access mode %s is not allowed for device class '%s'", capability.AccessMode.Mode, class.name),
+			)
+		}
+	}
+	volumeGroups := class.volumeGroups
+
+	// Get all of the logical volumes
+	// Note: Names are unique across every volume group, not just this class
+	lvs, err := server.getAllLVs(ctx)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateVolume Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Generate a unique name with the following format: elvm-csi-HASH
+	// Note: HASH is the fnv hash of the name
+	hasher := fnv.New64a()
+	hasher.Write([]byte(request.Name))
+	volumeName := fmt.Sprintf("elvm-csi-%d", hasher.Sum64())
+
+	// Retries of a request that already succeeded get the same volume back
+	// Note: The spec says that this should pass
+	// https://github.com/container-storage-interface/spec/blob/master/spec.md#createvolume
+	requestTags := getRequestTags(request)
+	for _, lv := range lvs {
+		if lv.Name != volumeName {
+			continue
+		}
+
+		if !hasTag(lv.Tags, ELVM_TAG) {
+			return nil, status.Error(
+				codes.Aborted,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Volume is still being deleted: %s", lv.Name),
+			)
+		}
+
+		if mismatch := getRequestMismatch(lv, request.Name, requestTags); mismatch != "" {
+			return nil, status.Error(
+				codes.AlreadyExists,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Volume exists already with a different %s: %s", mismatch, lv.Name),
+			)
+		}
+
+		volume := server.toCSIVolume(lv)
+		volume.ContentSource = request.VolumeContentSource
+
+		return &csi.CreateVolumeResponse{
+			Volume: volume,
+		}, nil
+	}
+
+	// Thin volumes are admitted against the pool instead of the VG
+	thinPool := class.thinPool
+	if pool, ok := request.Parameters[VOLUME_PARAM_THIN_POOL]; ok {
+		thinPool = pool
+	}
+
+	// Encrypted volumes are set up with LUKS when they are first staged, unless
+	// they only need a throwaway key
+	encryption := ""
+	if value, ok := request.Parameters[VOLUME_PARAM_ENCRYPTED]; ok {
+		if value == ENCRYPTION_EPHEMERAL {
+			encryption = ENCRYPTION_EPHEMERAL
+		} else if encrypted, err := strconv.ParseBool(value); err != nil {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				fmt.Sprintf(
+					"[ERROR] ControllerCreateVolume Invalid parameter '%s': %s. Must be a boolean or '%s'",
+					VOLUME_PARAM_ENCRYPTED,
+					value,
+					ENCRYPTION_EPHEMERAL,
+				),
+			)
+		} else if encrypted {
+			encryption = ENCRYPTION_LUKS
+		}
+	}
+
+	// Sources can only be copied or snapshotted within the same volume group, so
+	// it must be one of the volume groups of the class
+	findContentSource := func(id string) (*parser.LV, error) {
+		sourceGroup, sourceName, err := server.deviceClasses.get().resolveVolumeId(id)
+		if err != nil {
+			return nil, nil
+		}
+
+		inClass := false
+		for _, vg := range volumeGroups {
+			if vg.Name == sourceGroup.Name {
+				inClass = true
+				break
+			}
+		}
+
+		if !inClass {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Volume content source '%s' is not in the requested device class", id),
+			)
+		}
+
+		for _, lv := range lvs {
+			if lv.VGName == sourceGroup.Name && lv.Name == sourceName {
+				return lv, nil
+			}
+		}
+
+		return nil, nil
+	}
+
+	// Find where the contents of the volume should come from, if anywhere
+	var contentSource *parser.LV
+	if request.VolumeContentSource != nil {
+		if snapshotSource := request.VolumeContentSource.GetSnapshot(); snapshotSource != nil {
+			contentSource, err = findContentSource(snapshotSource.SnapshotId)
+			if err != nil {
+				return nil, err
+			}
+
+			if contentSource == nil || !hasTag(contentSource.Tags, ELVM_SNAPSHOT_TAG) {
+				return nil, status.Error(
+					codes.NotFound,
+					fmt.Sprintf("[ERROR] ControllerCreateVolume Could not find requested snapshot: %s", snapshotSource.SnapshotId),
+				)
+			}
+
+			if !toCSISnapshot(contentSource).ReadyToUse {
+				return nil, status.Error(
+					codes.FailedPrecondition,
+					fmt.Sprintf("[ERROR] ControllerCreateVolume Requested snapshot is not ready to use: %s", snapshotSource.SnapshotId),
+				)
+			}
+		} else if volumeSource := request.VolumeContentSource.GetVolume(); volumeSource != nil {
+			contentSource, err = findContentSource(volumeSource.VolumeId)
+			if err != nil {
+				return nil, err
+			}
+
+			if contentSource == nil {
+				return nil, status.Error(
+					codes.NotFound,
+					fmt.Sprintf("[ERROR] ControllerCreateVolume Could not find requested source volume: %s", volumeSource.VolumeId),
+				)
+			}
+
+			if !hasTag(contentSource.Tags, ELVM_TAG) {
+				return nil, status.Error(
+					codes.InvalidArgument,
+					fmt.Sprintf("[ERROR] ControllerCreateVolume Requested source volume is not managed by ELVM: %s", volumeSource.VolumeId),
+				)
+			}
+		} else {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"[ERROR] ControllerCreateVolume Unsupported volume content source.",
+			)
+		}
+	}
+
+	// Restored and cloned volumes get the exact contents of their source, so they
+	// can't change whether they are encrypted
+	if contentSource != nil {
+		sourceEncryption := getEncryption(contentSource)
+		if sourceEncryption == ENCRYPTION_EPHEMERAL {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"[ERROR] ControllerCreateVolume Volume content sources with ephemeral encryption can never be read back.",
+			)
+		}
+
+		if sourceEncryption != encryption {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				fmt.Sprintf(
+					"[ERROR] ControllerCreateVolume Encryption of the volume ('%s') must match its content source ('%s')",
+					getEncryptionContext(encryption),
+					getEncryptionContext(sourceEncryption),
+				),
+			)
+		}
+	}
+
+	// Restored and cloned volumes must be able to hold all of their source
+	required := uint64(request.CapacityRange.RequiredBytes)
+	limit := uint64(request.CapacityRange.LimitBytes)
+	if contentSource != nil {
+		// Thick snapshots are only as big as their COW area, so go by their origin
+		sourceSize := contentSource.Size
+		if hasTag(contentSource.Tags, ELVM_SNAPSHOT_TAG) {
+			sourceSize = getSnapshotOriginSize(contentSource)
+		}
+
+		if limit != 0 && limit < sourceSize {
+			return nil, status.Error(
+				codes.OutOfRange,
+				fmt.Sprintf(
+					"[ERROR] ControllerCreateVolume Requested limit is smaller than the volume content source. Limit (%d) < Source (%d)",
+					limit,
+					sourceSize,
+				),
+			)
+		}
+
+		if required < sourceSize {
+			required = sourceSize
+		}
+
+		// Thin sources can only be snapshotted within their own pool
+		if pool, ok := getTagValue(contentSource.Tags, ELVM_POOL_TAG_PREFIX); ok && contentSource.Attributes.Type == parser.VolumeTypeThin {
+			thinPool = pool
+		}
+
+		// The new volume has to live next to its source
+		for _, vg := range volumeGroups {
+			if vg.Name == contentSource.VGName {
+				volumeGroups = []*parser.VG{vg}
+				break
+			}
+		}
+	}
+
+	// Never make volumes smaller than the configured minimum
+	if required < server.minimumVolumeSize {
+		if limit != 0 && limit < server.minimumVolumeSize {
+			return nil, status.Error(
+				codes.OutOfRange,
+				fmt.Sprintf(
+					"[ERROR] ControllerCreateVolume Requested limit is smaller than the minimum volume size. Limit (%d) < Minimum (%d)",
+					limit,
+					server.minimumVolumeSize,
+				),
+			)
+		}
+
+		required = server.minimumVolumeSize
+	}
+
+	// Pick the volume group to create the volume in
+	candidates, err := server.getPlacementCandidates(ctx, volumeGroups, thinPool, class.reserve)
+	if err != nil {
+		return nil, status.Error(
+			status.Code(err),
+			fmt.Sprintf("[ERROR] ControllerCreateVolume Could not get available capacity: %s", status.Convert(err).Message()),
+		)
+	}
+
+	volumeGroup, capacity, err := server.placeVolume(ctx, class, candidates, required, limit, thinPool != "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Create some unique tags to show ownership
+	tags := []string{
+		ELVM_TAG,
+		ELVM_NAME_TAG_PREFIX + request.Name,
+		ELVM_CLASS_TAG_PREFIX + class.name,
+		fmt.Sprintf("%s%d", ELVM_CREATED_TAG_PREFIX, time.Now().Unix()),
+	}
+	tags = append(tags, requestTags...)
+	if thinPool != "" {
+		tags = append(tags, ELVM_POOL_TAG_PREFIX + thinPool)
+	}
+	if encryption != "" {
+		tags = append(tags, ELVM_ENCRYPTION_TAG_PREFIX + encryption)
+	}
+	if server.bootId != "" {
+		tags = append(tags, ELVM_BOOT_TAG_PREFIX + server.bootId)
+	}
+
+	// New extents can still hold whatever the last tenant left in them
+	// Note: Copies overwrite all of the volume anyway, so only empty ones need this.
+	sanitize := SANITIZE_NONE
+	if contentSource == nil {
+		sanitize = getSanitizePolicy(class, SANITIZE_ON_CREATE, thinPool != "")
+	}
+	if sanitize == SANITIZE_ZERO {
+		tags = append(tags, ELVM_SANITIZE_TAG_PREFIX + sanitize)
+	}
+
+	// Actually create the volume
+	if err := server.createLogicalVolume(ctx, class, volumeGroup, volumeName, capacity, thinPool, contentSource, tags); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateVolume Could not create logical volume: %s", err.Error()),
+		)
+	}
+
+	logicalVolume := &parser.LV{
+		Name: volumeName,
+		Size: capacity,
+		Tags: tags,
+		VGName: volumeGroup.Name,
+	}
+
+	// Zero-filling takes a while, so the volume can't be staged until it is done
+	if err := server.sanitizer.sanitizeNew(ctx, logicalVolume, sanitize); err != nil {
+		policy := getSanitizePolicy(class, SANITIZE_ON_DELETE, thinPool != "")
+		if output, removeErr := server.sanitizer.remove(ctx, logicalVolume, policy); removeErr != nil {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Could not remove logical volume '%s' after failing to sanitize it: %s | %s",
+					volumeName,
+					output,
+					removeErr.Error(),
+				),
+			)
+		}
+
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerCreateVolume Could not sanitize logical volume: %s", err.Error()),
+		)
+	}
+
+	volume := server.toCSIVolume(logicalVolume)
+	volume.ContentSource = request.VolumeContentSource
+
+	return &csi.CreateVolumeResponse{
+		Volume: volume,
+	}, nil
+}
+
+// The space that volumes can be created or grown into, less the configured reserve
+// Note: Thin volumes are admitted against their pool instead of the VG
+func (server *elvmControllerServer) getAvailableCapacity(ctx context.Context, vg *parser.VG, thinPool string, reserve uint64) (uint64, error) {
+	available := vg.FreeSize
+	if thinPool != "" {
+		poolAvailable, err := getThinPoolAvailable(ctx, vg, thinPool, server.overprovisionRatio)
+		if err != nil {
+			return 0, err
+		}
+
+		available = poolAvailable
+	}
+
+	if available <= reserve {
+		return 0, nil
+	}
+
+	return available - reserve, nil
 }
 
-func (server *elvmControllerServer) ControllerGetVolume(ctx context.Context, reqeust *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	log.Println("CONTROLLER: GET_VOLUME")
-	return nil, nil
+// Refreshes each volume group and finds how much space it has left for volumes
+// Note: Volume groups that can't hold the volume at all, such as ones without
+// the requested thin pool, are left out. If none are left, failures to query LVM
+// are reported over missing pools, since those might pass on a retry.
+func (server *elvmControllerServer) getPlacementCandidates(ctx context.Context, volumeGroups []*parser.VG, thinPool string, reserve uint64) ([]*placementCandidate, error) {
+	candidates := []*placementCandidate{}
+	var lastErr error
+	var queryErr error
+	for _, volumeGroup := range volumeGroups {
+		vg, err := getCurrentVG(ctx, volumeGroup)
+		if err != nil {
+			queryErr = err
+			continue
+		}
+
+		available, err := server.getAvailableCapacity(ctx, vg, thinPool, reserve)
+		if err != nil {
+			var notFound *thinPoolNotFoundError
+			if !errors.As(err, &notFound) {
+				queryErr = err
+			}
+
+			lastErr = err
+			continue
+		}
+
+		candidates = append(candidates, &placementCandidate{
+			vg: vg,
+			available: available,
+		})
+	}
+
+	if len(candidates) == 0 && queryErr != nil {
+		return nil, status.Error(codes.Internal, queryErr.Error())
+	}
+
+	if len(candidates) == 0 && lastErr != nil {
+		return nil, status.Error(codes.InvalidArgument, lastErr.Error())
+	}
+
+	return candidates, nil
 }
 
-func (server *elvmControllerServer) CreateSnapshot(ctx context.Context, reqeust *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	log.Println("CONTROLLER: CREATE_SNAPSHOT")
-	return nil, nil
+// Chooses a volume group by the placement policy, falling back to the next one
+// whenever the volume does not fit, and sizes the volume to whole extents
+func (server *elvmControllerServer) placeVolume(ctx context.Context, class *deviceClass, candidates []*placementCandidate, required uint64, limit uint64, thin bool) (*parser.VG, uint64, error) {
+	var lastErr error
+	for _, candidate := range server.deviceClasses.get().orderCandidates(class, candidates) {
+		if required > candidate.available {
+			lastErr = status.Error(
+				codes.ResourceExhausted,
+				fmt.Sprintf(
+					"[ERROR] ControllerCreateVolume Not enough space available for request. Requested (%d) > Available (%d)",
+					required,
+					candidate.available,
+				),
+			)
+			continue
+		}
+
+		var capacity uint64
+		var err error
+		if thin {
+			capacity, err = getThinCapacity(candidate.available, required, limit)
+		} else {
+			capacity, err = getCapacity(candidate.available, required, limit)
+		}
+
+		if err != nil {
+			lastErr = status.Error(
+				codes.FailedPrecondition,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Requested capacity cannot be allocated: %s", err.Error()),
+			)
+			continue
+		}
+
+		// LVM allocates whole extents, so make sure that the rounded size still fits
+		extentSize, err := getExtentSize(ctx, candidate.vg)
+		if err != nil {
+			return nil, 0, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Could not get extent size of volume group: %s", err.Error()),
+			)
+		}
+
+		capacity, err = alignToExtent(capacity, extentSize, required, limit, candidate.available)
+		if err != nil {
+			lastErr = status.Error(
+				codes.OutOfRange,
+				fmt.Sprintf("[ERROR] ControllerCreateVolume Requested capacity cannot be allocated: %s", err.Error()),
+			)
+			continue
+		}
+
+		if len(candidates) > 1 {
+			log.Println(
+				fmt.Sprintf(
+					"[INFO] Placing volume in volume group '%s' by policy '%s'",
+					candidate.vg.Name,
+					class.placementPolicy,
+				),
+			)
+		}
+
+		return candidate.vg, capacity, nil
+	}
+
+	return nil, 0, lastErr
 }
 
-func (server *elvmControllerServer) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	log.Println("CONTROLLER: DELETE_SNAPSHOT")
-	return nil, nil
+// Lists the logical volumes of every volume group managed by ELVM
+func (server *elvmControllerServer) getAllLVs(ctx context.Context) ([]*parser.LV, error) {
+	lvs := []*parser.LV{}
+	for _, vg := range server.deviceClasses.get().getAllVolumeGroups() {
+		vgLVs, err := getCurrentLVs(ctx, vg)
+		if err != nil {
+			return nil, err
+		}
+
+		lvs = append(lvs, vgLVs...)
+	}
+
+	return lvs, nil
 }
 
-func (server *elvmControllerServer) ListSnapshots(ctx context.Context, reqeust *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	log.Println("CONTROLLER: LIST_SNAPSHOTS")
-	return nil, nil
+// Converts an ID into its canonical VG/LV form so that IDs can be compared
+func (server *elvmControllerServer) normalizeVolumeId(volumeId string) string {
+	volumeGroup, name, err := server.deviceClasses.get().resolveVolumeId(volumeId)
+	if err != nil {
+		return ""
+	}
+
+	return volumeGroup.Name + "/" + name
 }
 
-func (server *elvmControllerServer) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	// Make sure that we have a name
-	if len(request.Name) == 0 {
-		return nil, status.Error(
-			codes.InvalidArgument,
-			"[ERROR] ControllerCreateVolume Name must be provided.",
-		)
+// Volumes only ever live on this node, so an open volume is published here
+func (server *elvmControllerServer) getPublishedNodeIds(logicalVolume *parser.LV) []string {
+	if logicalVolume.Attributes.Open == parser.VolumeOpenIsOpen {
+		return []string{server.nodeId}
 	}
 
-	// Make sure that we have been given the capability that we require
-	if len(request.VolumeCapabilities) != 1 || request.VolumeCapabilities[0].AccessMode.Mode != SUPPORTED_CAPABILITY {
-		return nil, status.Error(
-			codes.InvalidArgument,
-			"[ERROR] ControllerCreateVolume Only `multi_node_multi_writer` is allowed as a volume capability.",
-		)
+	return []string{}
+}
+
+// Records what a volume was requested with, so that a retry of the same request
+// can be told apart from a different one that happens to reuse the name
+// Note: Parameters and IDs can hold characters that LVM does not allow in tags,
+// so only their hashes are kept.
+func getRequestTags(request *csi.CreateVolumeRequest) []string {
+	tags := []string{
+		fmt.Sprintf(
+			"%s%d-%d",
+			ELVM_CAPACITY_TAG_PREFIX,
+			request.CapacityRange.GetRequiredBytes(),
+			request.CapacityRange.GetLimitBytes(),
+		),
 	}
 
-	// Make sure that the size is valid
-	if request.CapacityRange == nil || request.CapacityRange.RequiredBytes < 0 || request.CapacityRange.LimitBytes < 0 {
-		return nil, status.Error(
-			codes.InvalidArgument,
-			"[ERROR] ControllerCreateVolume CapacityRange must be provided.",
-		)
+	keys := []string{}
+	for key := range request.Parameters {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	vg, err := getCurrentVG(ctx, server.volumeGroup)
-	if err != nil {
-		return nil, status.Error(
-			codes.Internal,
-			fmt.Sprintf("[ERROR] ControllerCreateVolume Could not get selected volume group: %s", err.Error()),
-		)
+	hasher := fnv.New64a()
+	for _, key := range keys {
+		hasher.Write([]byte(key + "\x00" + request.Parameters[key] + "\x00"))
 	}
+	tags = append(tags, fmt.Sprintf("%s%016x", ELVM_PARAMETERS_TAG_PREFIX, hasher.Sum64()))
 
-	available := vg.FreeSize
-	if request.CapacityRange.RequiredBytes < 0 || uint64(request.CapacityRange.RequiredBytes) > available {
-		return nil, status.Error(
-			codes.ResourceExhausted,
-			fmt.Sprintf(
-				"[ERROR] ControllerCreateVolume Not enough space available for request. Requested (%d) > Available (%d)",
-				request.CapacityRange.RequiredBytes,
-				available,
-			),
-		)
+	source := ""
+	if snapshotSource := request.VolumeContentSource.GetSnapshot(); snapshotSource != nil {
+		source = "snapshot:" + snapshotSource.SnapshotId
+	} else if volumeSource := request.VolumeContentSource.GetVolume(); volumeSource != nil {
+		source = "volume:" + volumeSource.VolumeId
 	}
 
-	capacity, err := getCapacity(available, uint64(request.CapacityRange.RequiredBytes), uint64(request.CapacityRange.LimitBytes))
-	if err != nil {
-		return nil, status.Error(
-			codes.FailedPrecondition,
-			fmt.Sprintf("[ERROR] ControllerCreateVolume Requested capacity cannot be allocated: %s", err.Error()),
-		)
+	if source != "" {
+		hasher = fnv.New64a()
+		hasher.Write([]byte(source))
+		tags = append(tags, fmt.Sprintf("%s%016x", ELVM_CONTENT_TAG_PREFIX, hasher.Sum64()))
 	}
 
-	// Generate a unique name with the following format: elvm-csi-HASH
-	// Note: HASH is the fnv hash of the name
-	hasher := fnv.New64a()
-	hasher.Write([]byte(request.Name))
-	volumeName := fmt.Sprintf("elvm-csi-%d", hasher.Sum64())
+	return tags
+}
 
-	// Make sure that this volume does not exist already
-	lvs, err := getCurrentLVs(ctx, server.volumeGroup)
-	if err != nil {
-		return nil, status.Error(
-			codes.Internal,
-			fmt.Sprintf("[ERROR] ControllerCreateVolume Could not list logical volumes: %s", err.Error()),
-		)
+// Describes the first way that an existing volume differs from a request, if any
+// Note: Volumes created before requests were recorded never match.
+func getRequestMismatch(logicalVolume *parser.LV, name string, requestTags []string) string {
+	if existing, _ := getTagValue(logicalVolume.Tags, ELVM_NAME_TAG_PREFIX); existing != name {
+		return "name"
 	}
 
-	for _, lv := range lvs {
-		if lv.Name == volumeName {
-			return nil, status.Error(
-				codes.AlreadyExists,
-				fmt.Sprintf("[ERROR] ControllerCreateVolume Volume exists already: %s", lv),
-			)
+	fields := []struct {
+		prefix string
+		description string
+	}{
+		{ELVM_CAPACITY_TAG_PREFIX, "capacity range"},
+		{ELVM_PARAMETERS_TAG_PREFIX, "set of parameters"},
+		{ELVM_CONTENT_TAG_PREFIX, "content source"},
+	}
+
+	for _, field := range fields {
+		wanted, _ := getTagValue(requestTags, field.prefix)
+		existing, _ := getTagValue(logicalVolume.Tags, field.prefix)
+		if wanted != existing {
+			return field.description
 		}
 	}
 
-	// Create some unique tags to show ownership
-	tags := []string{
-		ELVM_TAG,
-		fmt.Sprintf("ELVM_NAME_%s", request.Name),
+	return ""
+}
+
+// Convert an ELVM volume into its CSI representation
+func (server *elvmControllerServer) toCSIVolume(logicalVolume *parser.LV) *csi.Volume {
+	volumeContext := map[string]string{
+		VOLUME_CONTEXT_VOLUME_GROUP: logicalVolume.VGName,
+	}
+	if thinPool, ok := getTagValue(logicalVolume.Tags, ELVM_POOL_TAG_PREFIX); ok {
+		volumeContext[VOLUME_CONTEXT_THIN_POOL] = thinPool
+	}
+	if class, err := server.deviceClasses.get().getDeviceClassOfVolume(logicalVolume); err == nil {
+		volumeContext[VOLUME_CONTEXT_DEVICE_CLASS] = class.name
+	}
+	if isEncrypted(logicalVolume) {
+		volumeContext[VOLUME_CONTEXT_ENCRYPTED] = getEncryptionContext(getEncryption(logicalVolume))
 	}
 
-	// Actually create the volume
-	createOut, createErr := commands.CreateLV(ctx, server.volumeGroup.Name, volumeName, capacity, 0, tags)
-	if createErr != nil {
-		return nil, status.Error(
-			codes.Internal,
+	return &csi.Volume{
+		CapacityBytes: int64(logicalVolume.Size),
+		VolumeId: getVolumeId(logicalVolume),
+		VolumeContext: volumeContext,
+		AccessibleTopology: []*csi.Topology{
+			getNodeTopology(server.nodeId),
+		},
+	}
+}
+
+// Creates a new volume, filling it with the contents of the source (if any)
+// Note: Thin sources are snapshotted, which is nearly instant, while everything
+// else needs a full block copy.
+func (server *elvmControllerServer) createLogicalVolume(ctx context.Context, class *deviceClass, volumeGroup *parser.VG, name string, capacity uint64, thinPool string, source *parser.LV, tags []string) error {
+	logicalVolume := &parser.LV{
+		Name: name,
+		VGName: volumeGroup.Name,
+	}
+
+	var output string
+	var err error
+	if source != nil && source.Attributes.Type == parser.VolumeTypeThin {
+		output, err = createThinSnapshotVolume(ctx, source, name, tags)
+	} else if thinPool != "" {
+		output, err = createThinLogicalVolume(ctx, volumeGroup.Name, thinPool, name, capacity, tags)
+	} else if class.stripes > 1 {
+		output, err = createStripedLogicalVolume(ctx, volumeGroup.Name, name, capacity, class.stripes, class.stripeSize, tags)
+	} else {
+		output, err = commands.CreateLV(ctx, volumeGroup.Name, name, capacity, 0, tags)
+	}
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s | %s", output, err.Error()))
+	}
+
+	// Nothing else to do for empty volumes
+	if source == nil {
+		return nil
+	}
+
+	// Thin snapshots start out the same size as their source, so grow them.
+	// Everything else needs to be copied over.
+	if source.Attributes.Type == parser.VolumeTypeThin {
+		if capacity > source.Size {
+			err = extendLogicalVolume(ctx, logicalVolume, capacity)
+		}
+	} else {
+		// Copying a volume that is in use might give an inconsistent clone
+		if source.Attributes.Open == parser.VolumeOpenIsOpen {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Source volume '%s' is in use. The copy might not be consistent.",
+					source.Name,
+				),
+			)
+		}
+
+		log.Println(
 			fmt.Sprintf(
-				"[ERROR] ControllerCreateVolume Could not create logical volume: %s | %s",
-				createOut,
-				createErr.Error(),
+				"[INFO] Copying contents of '%s' into '%s'",
+				source.Name,
+				name,
 			),
 		)
+
+		err = copyLogicalVolume(ctx, source, logicalVolume)
 	}
 
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			CapacityBytes: int64(capacity),
-			VolumeId: volumeName,
-		},
-	}, nil
+	// Make sure to not leave a half-filled volume lying around
+	if err != nil {
+		thin := thinPool != "" || source.Attributes.Type == parser.VolumeTypeThin
+		policy := getSanitizePolicy(class, SANITIZE_ON_DELETE, thin)
+		if output, removeErr := server.sanitizer.remove(ctx, logicalVolume, policy); removeErr != nil {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Could not clean up logical volume '%s': %s | %s",
+					name,
+					output,
+					removeErr.Error(),
+				),
+			)
+		}
+
+		return err
+	}
+
+	return nil
 }
 
 func (server *elvmControllerServer) DeleteVolume(ctx context.Context, request *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -156,17 +1296,26 @@ func (server *elvmControllerServer) DeleteVolume(ctx context.Context, request *c
 		)
 	}
 
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerDeleteVolume Could not find requested logical volume: %s", err.Error()),
+		)
+	}
+
 	// Make sure that the volume group still exists
-	_, err := getCurrentVG(ctx, server.volumeGroup)
+	_, err = getCurrentVG(ctx, volumeGroup)
 	if err != nil {
 		return nil, status.Error(
 			codes.Internal,
-			fmt.Sprintf("[ERROR] ControllerCreateVolume Could not get selected volume group: %s", err.Error()),
+			fmt.Sprintf("[ERROR] ControllerDeleteVolume Could not get selected volume group: %s", err.Error()),
 		)
 	}
 
 	// Get all of the logical volumes
-	lvs, err := getCurrentLVs(ctx, server.volumeGroup)
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
 	if err != nil {
 		return nil, status.Error(
 			codes.Internal,
@@ -177,7 +1326,7 @@ func (server *elvmControllerServer) DeleteVolume(ctx context.Context, request *c
 	// Make sure that the requested volume exists
 	var selectedLogicalVolume *parser.LV
 	for _, lv := range lvs {
-		if lv.Name == request.VolumeId {
+		if lv.Name == volumeName {
 			selectedLogicalVolume = lv
 			break
 		}
@@ -190,6 +1339,12 @@ func (server *elvmControllerServer) DeleteVolume(ctx context.Context, request *c
 		)
 	}
 
+	// Volumes that are being sanitized on their way out are already deleted, as
+	// far as the CO is concerned
+	if isSanitizing(selectedLogicalVolume) && !hasTag(selectedLogicalVolume.Tags, ELVM_TAG) {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
 	// Make sure that the volume is managed by ELVM
 	hasELVMTag := false
 	for _, tag := range selectedLogicalVolume.Tags {
@@ -206,8 +1361,20 @@ func (server *elvmControllerServer) DeleteVolume(ctx context.Context, request *c
 		)
 	}
 
-	// Actually delete the logical volume
-	output, err := commands.RemoveLV(ctx, server.volumeGroup.Name, selectedLogicalVolume.Name)
+	// Removing an origin would also remove its snapshots, so refuse to do so
+	for _, lv := range lvs {
+		if source, ok := getTagValue(lv.Tags, ELVM_SOURCE_TAG_PREFIX); ok && hasTag(lv.Tags, ELVM_SNAPSHOT_TAG) && source == selectedLogicalVolume.Name {
+			return nil, status.Error(
+				codes.FailedPrecondition,
+				fmt.Sprintf("[ERROR] ControllerDeleteVolume Volume still has snapshots: %s", lv.Name),
+			)
+		}
+	}
+
+	// Actually delete the logical volume, making sure that the next tenant can't
+	// read what was left behind
+	policy := getRemovalSanitizePolicy(server.deviceClasses.get(), selectedLogicalVolume)
+	output, err := server.sanitizer.remove(ctx, selectedLogicalVolume, policy)
 	if err != nil {
 		return nil, status.Error(
 			codes.Internal,
@@ -233,18 +1400,221 @@ func (server *elvmControllerServer) ControllerUnpublishVolume(ctx context.Contex
 }
 
 func (server *elvmControllerServer) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	log.Println("CONTROLLER: VALIDATE_VOLUME_CAPABILITIES")
-	return nil, nil
+	// Make sure that we have a volume ID
+	if len(request.VolumeId) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerValidateVolumeCapabilities Volume ID must be provided.",
+		)
+	}
+
+	// Make sure that we have capabilities to check
+	if len(request.VolumeCapabilities) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerValidateVolumeCapabilities Volume capabilities must be provided.",
+		)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerValidateVolumeCapabilities Could not find requested logical volume: %s", err.Error()),
+		)
+	}
+
+	// Get all of the logical volumes
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerValidateVolumeCapabilities Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Make sure that the volume exists and is managed by ELVM
+	logicalVolume := findLogicalVolume(lvs, volumeName)
+	if logicalVolume == nil || !hasTag(logicalVolume.Tags, ELVM_TAG) {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] ControllerValidateVolumeCapabilities Could not find requested ELVM volume: %s", request.VolumeId),
+		)
+	}
+
+	class, err := server.deviceClasses.get().getDeviceClassOfVolume(logicalVolume)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerValidateVolumeCapabilities Could not find device class of volume: %s", err.Error()),
+		)
+	}
+
+	// All of the capabilities must be supported to be confirmed
+	for _, capability := range request.VolumeCapabilities {
+		if err := checkExistingVolumeCapability(capability, server.allowMultiNode); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: err.Error(),
+			}, nil
+		}
+
+		if !class.allowsAccessMode(capability.AccessMode.Mode) {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("Access mode %s is not allowed for device class '%s'", capability.AccessMode.Mode, class.name),
+			}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext: request.VolumeContext,
+			VolumeCapabilities: request.VolumeCapabilities,
+			Parameters: request.Parameters,
+		},
+	}, nil
 }
 
 func (server *elvmControllerServer) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	log.Println("CONTROLLER: LIST_VOLUMES")
-	return nil, nil
+	// Make sure that the page size is valid
+	if request.MaxEntries < 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] ControllerListVolumes Max entries cannot be negative.",
+		)
+	}
+
+	// Get all of the logical volumes
+	lvs, err := server.getAllLVs(ctx)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] ControllerListVolumes Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Filter out everything that isn't managed by ELVM
+	// Note: Inline ephemeral volumes are never seen by the CO's controller side,
+	// and volumes being sanitized are hidden until they are clean.
+	volumes := []*parser.LV{}
+	for _, lv := range lvs {
+		if hasTag(lv.Tags, ELVM_TAG) && !hasTag(lv.Tags, ELVM_INLINE_TAG) && !isSanitizing(lv) {
+			volumes = append(volumes, lv)
+		}
+	}
+
+	page, nextToken, err := getPage(volumes, request.MaxEntries, request.StartingToken)
+	if err != nil {
+		return nil, status.Error(
+			codes.Aborted,
+			fmt.Sprintf("[ERROR] ControllerListVolumes %s", err.Error()),
+		)
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for _, volume := range page {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: server.toCSIVolume(volume),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: server.getPublishedNodeIds(volume),
+				VolumeCondition: getVolumeCondition(volume, lvs),
+			},
+		})
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries: entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (server *elvmControllerServer) GetCapacity(ctx context.Context, request *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	log.Println("CONTROLLER: GET_CAPACITY")
-	return nil, nil
+	// Volumes with capabilities that we don't support can't be created at all
+	for _, capability := range request.VolumeCapabilities {
+		if err := checkVolumeCapability(capability, server.allowMultiNode); err != nil {
+			return &csi.GetCapacityResponse{
+				AvailableCapacity: 0,
+			}, nil
+		}
+	}
+
+	// Volumes only exist on this node, so there is no capacity anywhere else
+	if request.AccessibleTopology != nil && !isTopologyForNode(request.AccessibleTopology, server.nodeId) {
+		return &csi.GetCapacityResponse{
+			AvailableCapacity: 0,
+		}, nil
+	}
+
+	// Find the requested device class
+	class, err := server.deviceClasses.get().getDeviceClass(request.Parameters[VOLUME_PARAM_DEVICE_CLASS])
+	if err != nil {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf("[ERROR] ControllerGetCapacity %s", err.Error()),
+		)
+	}
+
+	// Nothing can be created with access modes that the class doesn't allow
+	for _, capability := range request.VolumeCapabilities {
+		if !class.allowsAccessMode(capability.AccessMode.Mode) {
+			return &csi.GetCapacityResponse{
+				AvailableCapacity: 0,
+			}, nil
+		}
+	}
+
+	thinPool := class.thinPool
+	if pool, ok := request.Parameters[VOLUME_PARAM_THIN_POOL]; ok {
+		thinPool = pool
+	}
+
+	candidates, err := server.getPlacementCandidates(ctx, class.volumeGroups, thinPool, class.reserve)
+	if err != nil {
+		return nil, status.Error(
+			status.Code(err),
+			fmt.Sprintf("[ERROR] ControllerGetCapacity Could not get available capacity: %s", status.Convert(err).Message()),
+		)
+	}
+
+	// A volume can't span volume groups, so the largest one is limited by the
+	// volume group with the most space
+	// Note: LVM allocates whole extents, so the largest volume is rounded down to one
+	var available uint64
+	var maximum uint64
+	for _, candidate := range candidates {
+		extentSize, err := getExtentSize(ctx, candidate.vg)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] ControllerGetCapacity Could not get extent size of volume group: %s", err.Error()),
+			)
+		}
+
+		candidateMaximum := candidate.available
+		if extentSize != 0 {
+			candidateMaximum = candidate.available - candidate.available % extentSize
+		}
+
+		available += candidate.available
+		if candidateMaximum > maximum {
+			maximum = candidateMaximum
+		}
+	}
+
+	response := &csi.GetCapacityResponse{
+		AvailableCapacity: int64(available),
+		MaximumVolumeSize: &wrappers.Int64Value{
+			Value: int64(maximum),
+		},
+	}
+
+	if server.minimumVolumeSize != 0 {
+		response.MinimumVolumeSize = &wrappers.Int64Value{
+			Value: int64(server.minimumVolumeSize),
+		}
+	}
+
+	return response, nil
 }
 
 func (server *elvmControllerServer) ControllerGetCapabilities(ctx context.Context, request *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -264,6 +1634,14 @@ func (server *elvmControllerServer) ControllerGetCapabilities(ctx context.Contex
 			toCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
 			toCapability(csi.ControllerServiceCapability_RPC_LIST_VOLUMES),
 			toCapability(csi.ControllerServiceCapability_RPC_GET_CAPACITY),
+			toCapability(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME),
+			toCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT),
+			toCapability(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS),
+			toCapability(csi.ControllerServiceCapability_RPC_CLONE_VOLUME),
+			toCapability(csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER),
+			toCapability(csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES),
+			toCapability(csi.ControllerServiceCapability_RPC_VOLUME_CONDITION),
+			toCapability(csi.ControllerServiceCapability_RPC_GET_VOLUME),
 		},
 	}, nil
 }
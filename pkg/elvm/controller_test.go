@@ -0,0 +1,124 @@
+package elvm
+
+import (
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/lvmd/parser"
+)
+
+func TestGetRequestMismatch(t *testing.T) {
+	newRequest := func() *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: "pvc-1",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+			Parameters: map[string]string{"deviceClass": "fast", "fsType": "xfs"},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "vg/snap"},
+				},
+			},
+		}
+	}
+
+	original := newRequest()
+	existing := &parser.LV{
+		Tags: append([]string{ELVM_TAG, ELVM_NAME_TAG_PREFIX + original.Name}, getRequestTags(original)...),
+	}
+
+	tests := []struct {
+		name string
+		change func(request *csi.CreateVolumeRequest)
+		expected string
+	}{
+		{
+			name: "same request",
+			change: func(request *csi.CreateVolumeRequest) {},
+			expected: "",
+		},
+		{
+			name: "same parameters in a new map",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.Parameters = map[string]string{"fsType": "xfs", "deviceClass": "fast"}
+			},
+			expected: "",
+		},
+		{
+			name: "different name",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.Name = "pvc-2"
+			},
+			expected: "name",
+		},
+		{
+			name: "different capacity",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.CapacityRange.RequiredBytes = 2 << 30
+			},
+			expected: "capacity range",
+		},
+		{
+			name: "added limit",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.CapacityRange.LimitBytes = 2 << 30
+			},
+			expected: "capacity range",
+		},
+		{
+			name: "different parameter",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.Parameters["fsType"] = "ext4"
+			},
+			expected: "set of parameters",
+		},
+		{
+			name: "parameter moved between keys",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.Parameters = map[string]string{"deviceClass": "fastfsType", "": "xfs"}
+			},
+			expected: "set of parameters",
+		},
+		{
+			name: "different snapshot",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.VolumeContentSource.GetSnapshot().SnapshotId = "vg/other"
+			},
+			expected: "content source",
+		},
+		{
+			name: "volume with the same ID",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "vg/snap"},
+					},
+				}
+			},
+			expected: "content source",
+		},
+		{
+			name: "no content source",
+			change: func(request *csi.CreateVolumeRequest) {
+				request.VolumeContentSource = nil
+			},
+			expected: "content source",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newRequest()
+			test.change(request)
+
+			if mismatch := getRequestMismatch(existing, request.Name, getRequestTags(request)); mismatch != test.expected {
+				t.Errorf("expected '%s', got '%s'", test.expected, mismatch)
+			}
+		})
+	}
+
+	// Volumes from before requests were recorded can't be told apart
+	legacy := &parser.LV{Tags: []string{ELVM_TAG, ELVM_NAME_TAG_PREFIX + original.Name}}
+	if mismatch := getRequestMismatch(legacy, original.Name, getRequestTags(original)); mismatch == "" {
+		t.Errorf("expected volume without request tags to never match")
+	}
+}
@@ -0,0 +1,183 @@
+package elvm
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/lvmd/parser"
+)
+
+// Settings of ephemeral encryption, with the key size in bits
+// Note: XTS splits the key in two, so this is AES-256.
+const (
+	EPHEMERAL_CIPHER = "aes-xts-plain64"
+	EPHEMERAL_KEY_SIZE = 512
+)
+
+func isEncrypted(logicalVolume *parser.LV) bool {
+	_, ok := getTagValue(logicalVolume.Tags, ELVM_ENCRYPTION_TAG_PREFIX)
+	return ok
+}
+
+func getEncryption(logicalVolume *parser.LV) string {
+	encryption, _ := getTagValue(logicalVolume.Tags, ELVM_ENCRYPTION_TAG_PREFIX)
+	return encryption
+}
+
+// How encryption is recorded in the volume context, which is "true" for LUKS
+// to match the `encrypted` parameter
+func getEncryptionContext(encryption string) string {
+	if encryption == ENCRYPTION_LUKS {
+		return "true"
+	}
+
+	return encryption
+}
+
+// Name of the dm-crypt mapping that holds the decrypted contents of a volume
+// Note: LVM doubles every - in the names of its own mappings, so a name with
+// single - between its parts can never clash with them.
+func getCryptMappingName(logicalVolume *parser.LV) string {
+	return fmt.Sprintf(
+		"%s-%s-crypt",
+		strings.Replace(logicalVolume.VGName, "-", "--", -1),
+		strings.Replace(logicalVolume.Name, "-", "--", -1),
+	)
+}
+
+func getCryptDevicePath(logicalVolume *parser.LV) string {
+	return "/dev/mapper/" + getCryptMappingName(logicalVolume)
+}
+
+func isCryptMappingOpen(logicalVolume *parser.LV) bool {
+	_, err := os.Stat(getCryptDevicePath(logicalVolume))
+	return err == nil
+}
+
+// The device that holds the data of a volume, which is the decrypted mapping
+// for encrypted volumes
+func getDataDevicePath(logicalVolume *parser.LV) string {
+	if isEncrypted(logicalVolume) {
+		return getCryptDevicePath(logicalVolume)
+	}
+
+	return getDevicePath(logicalVolume)
+}
+
+// Opens the decrypted mapping of a volume, setting up LUKS on first use
+// Note: Only empty volumes are ever formatted, so a volume that somehow lost its
+// LUKS header is never overwritten.
+func openEncryptedVolume(ctx context.Context, logicalVolume *parser.LV, passphrase string) error {
+	if isCryptMappingOpen(logicalVolume) {
+		return nil
+	}
+
+	device := getDevicePath(logicalVolume)
+	if !isLuksDevice(ctx, device) {
+		info, err := getDeviceInfo(device)
+		if err != nil {
+			return err
+		}
+
+		if info.FsType != "" {
+			return errors.New(fmt.Sprintf("Volume contains '%s' instead of LUKS. Refusing to format it.", info.FsType))
+		}
+
+		log.Println(
+			fmt.Sprintf(
+				"[INFO] Setting up LUKS on logical volume '%s'",
+				logicalVolume.Name,
+			),
+		)
+
+		// Note: LUKS1 because LUKS2 needs the passphrase to resize, which
+		// NodeExpandVolume never gets.
+		if err := runCryptsetup(ctx, passphrase, "luksFormat", "--type", "luks1", "--batch-mode", "--key-file=-", device); err != nil {
+			return err
+		}
+	}
+
+	return runCryptsetup(ctx, passphrase, "luksOpen", "--key-file=-", device, getCryptMappingName(logicalVolume))
+}
+
+// Opens a plain dm-crypt mapping with a fresh random key, which is never stored
+// anywhere but the kernel
+// Note: Whatever was written under an earlier key is unreadable, so the volume
+// always looks empty when it is opened.
+func openEphemeralVolume(ctx context.Context, logicalVolume *parser.LV) error {
+	if isCryptMappingOpen(logicalVolume) {
+		return nil
+	}
+
+	key := make([]byte, EPHEMERAL_KEY_SIZE / 8)
+	if _, err := rand.Read(key); err != nil {
+		return errors.New(fmt.Sprintf("Could not generate key: %s", err.Error()))
+	}
+
+	log.Println(
+		fmt.Sprintf(
+			"[INFO] Opening logical volume '%s' with a new ephemeral key",
+			logicalVolume.Name,
+		),
+	)
+
+	return runCryptsetup(
+		ctx,
+		string(key),
+		"open",
+		"--type=plain",
+		"--cipher=" + EPHEMERAL_CIPHER,
+		fmt.Sprintf("--key-size=%d", EPHEMERAL_KEY_SIZE),
+		"--key-file=-",
+		getDevicePath(logicalVolume),
+		getCryptMappingName(logicalVolume),
+	)
+}
+
+func closeEncryptedVolume(ctx context.Context, logicalVolume *parser.LV) error {
+	if !isCryptMappingOpen(logicalVolume) {
+		return nil
+	}
+
+	return runCryptsetup(ctx, "", "close", getCryptMappingName(logicalVolume))
+}
+
+// Grows the decrypted mapping to fill its volume
+// Note: This works without a key for LUKS1 and for plain mappings, since both
+// only need the key that the kernel already holds for the open mapping.
+func resizeEncryptedVolume(ctx context.Context, logicalVolume *parser.LV) error {
+	return runCryptsetup(ctx, "", "resize", getCryptMappingName(logicalVolume))
+}
+
+func isLuksDevice(ctx context.Context, device string) bool {
+	return runCryptsetup(ctx, "", "isLuks", device) == nil
+}
+
+// Note: Keys are passed through stdin so that they never show up in the
+// process list.
+func runCryptsetup(ctx context.Context, key string, args ...string) error {
+	command := "cryptsetup"
+
+	// Make sure that we have the needed command
+	if !isCommandAvailable(command) {
+		return errors.New("Could not find command in path: " + command)
+	}
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	if key != "" {
+		cmd.Stdin = strings.NewReader(key)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	return nil
+}
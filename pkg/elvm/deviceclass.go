@@ -0,0 +1,416 @@
+package elvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/lvmd/commands"
+	"github.com/google/lvmd/parser"
+)
+
+// Device classes are named sets of storage that a StorageClass can select
+// through the `deviceClass` parameter
+type deviceClasses struct {
+	classes map[string]*deviceClass
+	defaultClass string
+
+	// Where the next round-robin placement starts, per class
+	lock sync.Mutex
+	nextPlacement map[string]int
+}
+
+// Holds the device classes in use, so that they can be replaced while requests
+// are being served
+type deviceClassStore struct {
+	current atomic.Value
+}
+
+func (store *deviceClassStore) get() *deviceClasses {
+	return store.current.Load().(*deviceClasses)
+}
+
+func (store *deviceClassStore) set(classes *deviceClasses) {
+	// Round-robin placement carries on where the old classes left off
+	if old, ok := store.current.Load().(*deviceClasses); ok {
+		old.lock.Lock()
+		for name, next := range old.nextPlacement {
+			if _, ok := classes.classes[name]; ok {
+				classes.nextPlacement[name] = next
+			}
+		}
+		old.lock.Unlock()
+	}
+
+	store.current.Store(classes)
+}
+
+// The resolved settings of a single device class
+type deviceClass struct {
+	name string
+	volumeGroups []*parser.VG
+	placementPolicy string
+	thinPool string
+	fsType string
+	mkfsOptions []string
+	mountOptions []string
+	stripes uint32
+	stripeSize uint64
+	reserve uint64
+	accessModes []csi.VolumeCapability_AccessMode_Mode
+	sanitize string
+	sanitizeOn string
+}
+
+// Builds the device classes from their config, filling in anything unset from
+// the command line arguments.
+// Note: Every problem is reported at once, so that a config can be fixed in a
+// single pass.
+func newDeviceClasses(ctx context.Context, config *Config, args *ELVMArgs) (*deviceClasses, error) {
+	problems := []string{}
+	addProblem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// Get all of the available volume groups
+	available, err := commands.ListVG(ctx)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not list volume groups: %s", err.Error()))
+	}
+
+	classes := &deviceClasses{
+		classes: map[string]*deviceClass{},
+		defaultClass: config.DefaultDeviceClass,
+		nextPlacement: map[string]int{},
+	}
+
+	if len(config.DeviceClasses) == 0 {
+		addProblem("At least one device class must be configured")
+	}
+
+	for i, classConfig := range config.DeviceClasses {
+		if classConfig.Name == "" {
+			addProblem("Device class #%d must have a name", i + 1)
+			continue
+		}
+
+		if _, ok := classes.classes[classConfig.Name]; ok {
+			addProblem("Device class '%s' is configured more than once", classConfig.Name)
+			continue
+		}
+
+		class := &deviceClass{
+			name: classConfig.Name,
+			placementPolicy: classConfig.PlacementPolicy,
+			thinPool: classConfig.ThinPool,
+			fsType: classConfig.FsType,
+			mkfsOptions: classConfig.MkfsOptions,
+			mountOptions: classConfig.MountOptions,
+			stripes: classConfig.Stripes,
+			stripeSize: classConfig.StripeSize,
+			reserve: args.Reserve,
+			sanitize: classConfig.Sanitize,
+			sanitizeOn: classConfig.SanitizeOn,
+		}
+		classes.classes[class.name] = class
+
+		if class.placementPolicy == "" {
+			class.placementPolicy = config.PlacementPolicy
+		}
+		if class.placementPolicy == "" {
+			class.placementPolicy = args.PlacementPolicy
+		}
+		if class.thinPool == "" {
+			class.thinPool = args.ThinPool
+		}
+		if class.fsType == "" {
+			class.fsType = config.FsType
+		}
+		if class.fsType == "" {
+			class.fsType = args.FsType
+		}
+		if class.sanitize == "" {
+			class.sanitize = config.Sanitize
+		}
+		if class.sanitize == "" {
+			class.sanitize = args.Sanitize
+		}
+		if class.sanitize == "" {
+			class.sanitize = SANITIZE_NONE
+		}
+		if class.sanitizeOn == "" {
+			class.sanitizeOn = config.SanitizeOn
+		}
+		if class.sanitizeOn == "" {
+			class.sanitizeOn = args.SanitizeOn
+		}
+		if class.sanitizeOn == "" {
+			class.sanitizeOn = SANITIZE_ON_DELETE
+		}
+		if config.Reserve != nil {
+			class.reserve = *config.Reserve
+		}
+		if classConfig.Reserve != nil {
+			class.reserve = *classConfig.Reserve
+		}
+
+		// Make sure that every volume group exists, and only once
+		if len(classConfig.VolumeGroups) == 0 {
+			addProblem("Device class '%s' must have at least one volume group", class.name)
+		}
+
+		for _, volumeGroup := range classConfig.VolumeGroups {
+			var found *parser.VG
+			for _, vg := range available {
+				if vg.Name == volumeGroup {
+					found = vg
+					break
+				}
+			}
+
+			if found == nil {
+				addProblem("Device class '%s' uses volume group '%s', which does not exist", class.name, volumeGroup)
+				continue
+			}
+
+			for _, vg := range class.volumeGroups {
+				if vg.Name == found.Name {
+					addProblem("Device class '%s' lists volume group '%s' more than once", class.name, volumeGroup)
+					break
+				}
+			}
+
+			class.volumeGroups = append(class.volumeGroups, found)
+		}
+
+		if !isPlacementPolicySupported(class.placementPolicy) {
+			addProblem("Device class '%s' has unsupported placement policy '%s'. Must be one of %v", class.name, class.placementPolicy, SUPPORTED_PLACEMENT_POLICIES)
+		}
+
+		// Make sure that the thin pool is usable, if specified
+		// Note: Volume groups without the pool are skipped when placing thin
+		// volumes, but at least one of them must have it.
+		if class.thinPool != "" && len(class.volumeGroups) != 0 {
+			var poolErr error
+			for _, vg := range class.volumeGroups {
+				if _, _, poolErr = getThinPoolUsage(ctx, vg, class.thinPool); poolErr == nil {
+					break
+				}
+			}
+
+			if poolErr != nil {
+				addProblem("Device class '%s' could not use thin pool '%s': %s", class.name, class.thinPool, poolErr.Error())
+			}
+		}
+
+		// Make sure that the fs type is supported and can be created
+		if !isFsTypeSupported(class.fsType) {
+			addProblem("Device class '%s' has unsupported fs type '%s'. Must be one of %v", class.name, class.fsType, SUPPORTED_FS_TYPES)
+		} else if !isCommandAvailable("mkfs." + class.fsType) {
+			addProblem("Device class '%s' needs mkfs.%s, which could not be found", class.name, class.fsType)
+		}
+
+		// Stripes only apply to thick volumes, which are allocated straight from the VG
+		if class.stripes > 1 && class.thinPool != "" {
+			addProblem("Device class '%s' cannot stripe volumes in thin pool '%s'", class.name, class.thinPool)
+		}
+
+		if class.stripeSize != 0 {
+			if class.stripes < 2 {
+				addProblem("Device class '%s' sets a stripe size without at least 2 stripes", class.name)
+			}
+
+			if class.stripeSize < 4096 || class.stripeSize & (class.stripeSize - 1) != 0 {
+				addProblem("Device class '%s' has invalid stripe size %d. Must be a power of 2 of at least 4096", class.name, class.stripeSize)
+			}
+		}
+
+		// Make sure that the sanitize policy is known and can be run
+		if !isSanitizePolicySupported(class.sanitize) {
+			addProblem("Device class '%s' has unsupported sanitize policy '%s'. Must be one of %v", class.name, class.sanitize, SUPPORTED_SANITIZE_POLICIES)
+		} else if command, ok := SANITIZE_COMMANDS[class.sanitize]; ok && !isCommandAvailable(command) {
+			addProblem("Device class '%s' needs %s, which could not be found", class.name, command)
+		}
+
+		if !isSanitizeTimingSupported(class.sanitizeOn) {
+			addProblem("Device class '%s' has unsupported sanitize timing '%s'. Must be one of %v", class.name, class.sanitizeOn, SUPPORTED_SANITIZE_TIMINGS)
+		}
+
+		// Make sure that every access mode is one that ELVM can provide
+		for _, name := range classConfig.AccessModes {
+			value, ok := csi.VolumeCapability_AccessMode_Mode_value[name]
+			mode := csi.VolumeCapability_AccessMode_Mode(value)
+			if !ok || !isAccessModeSupported(mode, args.AllowMultiNode) {
+				addProblem("Device class '%s' has unsupported access mode '%s'", class.name, name)
+				continue
+			}
+
+			class.accessModes = append(class.accessModes, mode)
+		}
+	}
+
+	if _, ok := classes.classes[classes.defaultClass]; !ok {
+		addProblem("Default device class '%s' is not configured", classes.defaultClass)
+	}
+
+	if len(problems) != 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid device class configuration:\n\t%s", strings.Join(problems, "\n\t")))
+	}
+
+	return classes, nil
+}
+
+func (d *deviceClasses) getDeviceClass(name string) (*deviceClass, error) {
+	if name == "" {
+		name = d.defaultClass
+	}
+
+	class, ok := d.classes[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown device class '%s'", name))
+	}
+
+	return class, nil
+}
+
+// Finds the class that a volume was created in
+// Note: Volumes created before classes were recorded, or whose class has since
+// been removed from the config, belong to the first class holding their volume
+// group, preferring the default one.
+func (d *deviceClasses) getDeviceClassOfVolume(logicalVolume *parser.LV) (*deviceClass, error) {
+	if name, ok := getTagValue(logicalVolume.Tags, ELVM_CLASS_TAG_PREFIX); ok {
+		if class, ok := d.classes[name]; ok {
+			return class, nil
+		}
+
+		log.Println(
+			fmt.Sprintf(
+				"[WARN] Device class '%s' of volume '%s' is no longer configured. Falling back to its volume group.",
+				name,
+				getVolumeId(logicalVolume),
+			),
+		)
+	}
+
+	names := []string{}
+	for name := range d.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names = append([]string{d.defaultClass}, names...)
+
+	for _, name := range names {
+		for _, vg := range d.classes[name].volumeGroups {
+			if vg.Name == logicalVolume.VGName {
+				return d.classes[name], nil
+			}
+		}
+	}
+
+	// Keep serving volumes whose volume group was dropped from the config, using
+	// the settings of the default class
+	defaultClass, ok := d.classes[d.defaultClass]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No device class uses volume group '%s'", logicalVolume.VGName))
+	}
+
+	log.Println(
+		fmt.Sprintf(
+			"[WARN] No device class uses volume group '%s' of volume '%s'. Using the settings of default class '%s'.",
+			logicalVolume.VGName,
+			getVolumeId(logicalVolume),
+			defaultClass.name,
+		),
+	)
+
+	fallback := *defaultClass
+	fallback.volumeGroups = []*parser.VG{{Name: logicalVolume.VGName}}
+	return &fallback, nil
+}
+
+func (d *deviceClasses) getVolumeGroups(deviceClass string) ([]*parser.VG, error) {
+	class, err := d.getDeviceClass(deviceClass)
+	if err != nil {
+		return nil, err
+	}
+
+	return class.volumeGroups, nil
+}
+
+// Whether volumes of this class may be used with the given access mode
+func (c *deviceClass) allowsAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	if len(c.accessModes) == 0 {
+		return true
+	}
+
+	for _, allowed := range c.accessModes {
+		if mode == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns every managed volume group exactly once, sorted by name
+func (d *deviceClasses) getAllVolumeGroups() []*parser.VG {
+	seen := map[string]bool{}
+	vgs := []*parser.VG{}
+	for _, class := range d.classes {
+		for _, vg := range class.volumeGroups {
+			if !seen[vg.Name] {
+				seen[vg.Name] = true
+				vgs = append(vgs, vg)
+			}
+		}
+	}
+
+	sort.Slice(vgs, func(i, j int) bool {
+		return vgs[i].Name < vgs[j].Name
+	})
+
+	return vgs
+}
+
+// Finds the volume group and LV name referenced by a volume (or snapshot) ID.
+// Note: IDs without a volume group predate device classes, so they belong to
+// the first volume group of the default class.
+func (d *deviceClasses) resolveVolumeId(volumeId string) (*parser.VG, string, error) {
+	vgName, lvName := parseVolumeId(volumeId)
+	if vgName == "" {
+		vgs, err := d.getVolumeGroups("")
+		if err != nil {
+			return nil, "", err
+		}
+
+		return vgs[0], lvName, nil
+	}
+
+	for _, vg := range d.getAllVolumeGroups() {
+		if vg.Name == vgName {
+			return vg, lvName, nil
+		}
+	}
+
+	return nil, "", errors.New(fmt.Sprintf("Volume group '%s' is not managed by ELVM", vgName))
+}
+
+// Volume IDs have the format VG/LV so that they can be found in any class
+func getVolumeId(logicalVolume *parser.LV) string {
+	return logicalVolume.VGName + "/" + logicalVolume.Name
+}
+
+func parseVolumeId(volumeId string) (string, string) {
+	parts := strings.SplitN(volumeId, "/", 2)
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+
+	return parts[0], parts[1]
+}
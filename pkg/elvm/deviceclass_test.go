@@ -0,0 +1,94 @@
+package elvm
+
+import (
+	"testing"
+
+	"github.com/google/lvmd/parser"
+)
+
+func TestGetDeviceClassOfVolume(t *testing.T) {
+	classes := &deviceClasses{
+		classes: map[string]*deviceClass{
+			"fast": {
+				name: "fast",
+				volumeGroups: []*parser.VG{{Name: "vg-fast"}},
+				fsType: "xfs",
+			},
+			"slow": {
+				name: "slow",
+				volumeGroups: []*parser.VG{{Name: "vg-slow"}, {Name: "vg-shared"}},
+				fsType: "ext4",
+			},
+			"shared": {
+				name: "shared",
+				volumeGroups: []*parser.VG{{Name: "vg-shared"}},
+				fsType: "ext4",
+			},
+		},
+		defaultClass: "fast",
+	}
+
+	tests := []struct {
+		name string
+		lv *parser.LV
+		class string
+		volumeGroup string
+	}{
+		{
+			name: "tagged",
+			lv: &parser.LV{VGName: "vg-shared", Tags: []string{ELVM_CLASS_TAG_PREFIX + "shared"}},
+			class: "shared",
+			volumeGroup: "vg-shared",
+		},
+		{
+			name: "untagged",
+			lv: &parser.LV{VGName: "vg-slow"},
+			class: "slow",
+			volumeGroup: "vg-slow",
+		},
+		{
+			name: "untagged in several classes",
+			lv: &parser.LV{VGName: "vg-shared"},
+			class: "shared",
+			volumeGroup: "vg-shared",
+		},
+		{
+			name: "class removed",
+			lv: &parser.LV{VGName: "vg-slow", Tags: []string{ELVM_CLASS_TAG_PREFIX + "gone"}},
+			class: "slow",
+			volumeGroup: "vg-slow",
+		},
+		{
+			name: "class and volume group removed",
+			lv: &parser.LV{VGName: "vg-gone", Tags: []string{ELVM_CLASS_TAG_PREFIX + "gone"}},
+			class: "fast",
+			volumeGroup: "vg-gone",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			class, err := classes.getDeviceClassOfVolume(test.lv)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if class.name != test.class {
+				t.Errorf("expected class '%s', got '%s'", test.class, class.name)
+			}
+
+			found := false
+			for _, vg := range class.volumeGroups {
+				found = found || vg.Name == test.volumeGroup
+			}
+			if !found {
+				t.Errorf("expected class to hold volume group '%s'", test.volumeGroup)
+			}
+		})
+	}
+
+	// The fallback must never change the configured default class
+	if len(classes.classes["fast"].volumeGroups) != 1 || classes.classes["fast"].volumeGroups[0].Name != "vg-fast" {
+		t.Errorf("default class was modified: %v", classes.classes["fast"].volumeGroups)
+	}
+}
@@ -2,62 +2,210 @@ package elvm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/google/lvmd/commands"
-	"github.com/google/lvmd/parser"
 )
 
 type ELVM struct {
-	//
+	args *ELVMArgs
+	// Shared by every endpoint so that a reload reaches all of them at once
+	deviceClasses *deviceClassStore
+	// ID of the current boot, which is recorded on every volume
+	bootId string
+	sanitizer *sanitizer
 }
 
 type ELVMArgs struct {
+	AllowMultiNode bool
+	// The device classes to serve
+	Config *Config
+	// Defaults for any device class setting left unset in the config
 	FsType string
+	// How often to look for orphaned volumes (0 disables it), how long a volume
+	// must go unused to count as orphaned and whether to only report them
+	GarbageCollectionInterval time.Duration
+	GarbageCollectionTTL time.Duration
+	GarbageCollectionDryRun bool
+	MinimumVolumeSize uint64
 	NodeId string
-	VolumeGroup string
+	OverprovisionRatio float64
+	PlacementPolicy string
+	// What to do with volumes created before the node last booted
+	PreviousBootPolicy string
+	Reserve uint64
+	// How and when to sanitize volumes of any device class that does not say
+	Sanitize string
+	SanitizeOn string
+	ThinPool string
 }
 
 const (
 	ELVM_TAG = "ELVM_CSI_VOLUME"
-	SUPPORTED_CAPABILITY = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	ELVM_SNAPSHOT_TAG = "ELVM_CSI_SNAPSHOT"
+	// Marks volumes that only live as long as the pod that they were published to
+	ELVM_INLINE_TAG = "ELVM_CSI_INLINE"
+	TOPOLOGY_KEY = "topology.elvm.csi/node"
+
+	// Prefixes for tags that carry a value
+	ELVM_NAME_TAG_PREFIX = "ELVM_NAME_"
+	ELVM_SOURCE_TAG_PREFIX = "ELVM_SOURCE_"
+	ELVM_ORIGIN_SIZE_TAG_PREFIX = "ELVM_ORIGIN_SIZE_"
+	ELVM_CREATED_TAG_PREFIX = "ELVM_CREATED_"
+	ELVM_LAST_USED_TAG_PREFIX = "ELVM_LAST_USED_"
+	ELVM_POOL_TAG_PREFIX = "ELVM_POOL_"
+	ELVM_CLASS_TAG_PREFIX = "ELVM_CLASS_"
+	ELVM_ENCRYPTION_TAG_PREFIX = "ELVM_ENCRYPTION_"
+	ELVM_BOOT_TAG_PREFIX = "ELVM_BOOT_"
+	ELVM_SANITIZE_TAG_PREFIX = "ELVM_SANITIZING_"
+	// What a volume was requested with, so that retries can be recognized
+	ELVM_CAPACITY_TAG_PREFIX = "ELVM_CAPACITY_"
+	ELVM_PARAMETERS_TAG_PREFIX = "ELVM_PARAMETERS_"
+	ELVM_CONTENT_TAG_PREFIX = "ELVM_CONTENT_"
+
+	// Ways that a volume can be encrypted
+	ENCRYPTION_LUKS = "luks"
+	// Plain dm-crypt with a random key that only ever lives in the kernel, so
+	// the data is gone for good once the volume is unstaged
+	ENCRYPTION_EPHEMERAL = "ephemeral"
+
+	// Parameters that can be supplied through a StorageClass
+	VOLUME_PARAM_DEVICE_CLASS = "deviceClass"
+	VOLUME_PARAM_ENCRYPTED = "encrypted"
+	VOLUME_PARAM_THIN_POOL = "thinPool"
+
+	// Keys of the context returned with every volume
+	VOLUME_CONTEXT_DEVICE_CLASS = "deviceClass"
+	VOLUME_CONTEXT_ENCRYPTED = "encrypted"
+	VOLUME_CONTEXT_VOLUME_GROUP = "volumeGroup"
+	VOLUME_CONTEXT_THIN_POOL = "thinPool"
+
+	// Attributes of inline ephemeral volumes, which are given in the pod spec
+	VOLUME_CONTEXT_EPHEMERAL = "csi.storage.k8s.io/ephemeral"
+	VOLUME_ATTRIBUTE_SIZE = "size"
+
+	// Secrets that can be supplied when staging a volume
+	SECRET_PASSPHRASE = "passphrase"
+
+	// Parameters that can be supplied through a VolumeSnapshotClass
+	SNAPSHOT_PARAM_COW_SIZE = "cowSize"
 )
 
-func (server ELVM) GetCSIEndpoints(args *ELVMArgs) (*elvmIdentityServer, *elvmControllerServer, *elvmNodeServer) {
-	// Get all of the available volume groups
-	volumeGroups, err := commands.ListVG(context.Background())
-	if err != nil {
-		log.Fatalln("[ERROR] Could not list volume groups:", err.Error())
+// ELVM volumes only ever exist on a single node, so these are always allowed
+var SUPPORTED_ACCESS_MODES = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
+
+// These are misleading for node-local volumes, so they must be explicitly enabled
+var MULTI_NODE_ACCESS_MODES = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// The only access mode that was advertised before multi-node modes had to be
+// enabled, so volumes provisioned with it must keep working
+const LEGACY_ACCESS_MODE = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+
+// Filesystems that can be created and grown online by the tools in the image
+var SUPPORTED_FS_TYPES = []string{
+	"btrfs",
+	"ext2",
+	"ext3",
+	"ext4",
+	"xfs",
+}
+
+func (server *ELVM) GetCSIEndpoints(args *ELVMArgs) (*elvmIdentityServer, *elvmControllerServer, *elvmNodeServer, error) {
+	if args.OverprovisionRatio < 1 {
+		return nil, nil, nil, errors.New(fmt.Sprintf("Overprovision ratio must be at least 1: %f", args.OverprovisionRatio))
 	}
 
-	// Ensure that the supplied volume group is available
-	var selectedVolumeGroup *parser.VG
-	for _, vg := range volumeGroups {
-		if vg.Name == args.VolumeGroup {
-			selectedVolumeGroup = vg
-			break
-		}
+	if args.GarbageCollectionInterval < 0 || args.GarbageCollectionTTL < 0 {
+		return nil, nil, nil, errors.New("Garbage collection interval and TTL cannot be negative")
 	}
 
-	if selectedVolumeGroup == nil {
-		log.Fatalln(fmt.Sprintf("[ERROR] Could not find volume group '%s' in %s", args.VolumeGroup, volumeGroups))
+	if args.PreviousBootPolicy == "" {
+		args.PreviousBootPolicy = PREVIOUS_BOOT_KEEP
 	}
 
-	// Make sure that the default fs type is available
-	if !isCommandAvailable("mkfs." + args.FsType) {
-		log.Fatalln(fmt.Sprintf("[ERROR] Could not find default fs executable: mkfs.%s", args.FsType))
+	if !isPreviousBootPolicySupported(args.PreviousBootPolicy) {
+		return nil, nil, nil, errors.New(
+			fmt.Sprintf(
+				"Unknown previous boot policy '%s'. Must be one of %v",
+				args.PreviousBootPolicy,
+				SUPPORTED_PREVIOUS_BOOT_POLICIES,
+			),
+		)
 	}
 
+	// Volumes can't be told apart by boot without knowing the current one
+	bootId, err := getBootId()
+	if err != nil {
+		if args.PreviousBootPolicy != PREVIOUS_BOOT_KEEP {
+			return nil, nil, nil, err
+		}
+
+		log.Println(
+			fmt.Sprintf(
+				"[WARN] %s. New volumes will not record the boot they were created in.",
+				err.Error(),
+			),
+		)
+	}
+
+	// Make sure that every device class is usable
+	classes, err := newDeviceClasses(context.Background(), args.Config, args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	server.args = args
+	server.bootId = bootId
+	server.sanitizer = newSanitizer()
+	server.deviceClasses = &deviceClassStore{}
+	server.deviceClasses.set(classes)
+
 	// Return the actual implementations
 	return &elvmIdentityServer{
-		volumeGroup: selectedVolumeGroup,
+		deviceClasses: server.deviceClasses,
 	}, &elvmControllerServer{
-		volumeGroup: selectedVolumeGroup,
+		deviceClasses: server.deviceClasses,
+		overprovisionRatio: args.OverprovisionRatio,
+		allowMultiNode: args.AllowMultiNode,
+		nodeId: args.NodeId,
+		minimumVolumeSize: args.MinimumVolumeSize,
+		bootId: bootId,
+		sanitizer: server.sanitizer,
 	}, &elvmNodeServer{
-		volumeGroup: selectedVolumeGroup,
+		deviceClasses: server.deviceClasses,
+		allowMultiNode: args.AllowMultiNode,
 		nodeId: args.NodeId,
-		fsType: args.FsType,
+		bootId: bootId,
+		previousBootPolicy: args.PreviousBootPolicy,
+		sanitizer: server.sanitizer,
+	}, nil
+}
+
+// Swaps in a new config for every endpoint. Requests that are already running
+// finish with whatever they have already looked up.
+// Note: The old config stays in use if the new one is invalid.
+func (server *ELVM) Reload(config *Config) error {
+	if server.deviceClasses == nil {
+		return errors.New("Endpoints must be set up before reloading")
 	}
+
+	classes, err := newDeviceClasses(context.Background(), config, server.args)
+	if err != nil {
+		return err
+	}
+
+	server.deviceClasses.set(classes)
+	return nil
 }
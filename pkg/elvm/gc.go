@@ -0,0 +1,235 @@
+package elvm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/lvmd/commands"
+	"github.com/google/lvmd/parser"
+)
+
+// Finds volumes left behind by crashed nodes or force-deleted pods
+// Note: Only inline volumes are ever removed, since they only exist while they
+// are published. Any other volume might still be bound to a claim whose pods are
+// scaled down, so those are only reported.
+type garbageCollector struct {
+	deviceClasses *deviceClassStore
+	sanitizer *sanitizer
+	ttl time.Duration
+	dryRun bool
+}
+
+// Runs the garbage collector once right away and then on every interval, until
+// the context is done. Does nothing if no interval was configured.
+func (server *ELVM) RunGarbageCollector(ctx context.Context) {
+	if server.args == nil || server.args.GarbageCollectionInterval == 0 {
+		return
+	}
+
+	collector := &garbageCollector{
+		deviceClasses: server.deviceClasses,
+		sanitizer: server.sanitizer,
+		ttl: server.args.GarbageCollectionTTL,
+		dryRun: server.args.GarbageCollectionDryRun,
+	}
+
+	ticker := time.NewTicker(server.args.GarbageCollectionInterval)
+	defer ticker.Stop()
+
+	for {
+		collector.collect(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (collector *garbageCollector) collect(ctx context.Context) {
+	now := time.Now()
+	for _, vg := range collector.deviceClasses.get().getAllVolumeGroups() {
+		lvs, err := getCurrentLVs(ctx, vg)
+		if err != nil {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Garbage collector could not list logical volumes of '%s': %s",
+					vg.Name,
+					err.Error(),
+				),
+			)
+			continue
+		}
+
+		// Removing the origin of a snapshot would take the snapshot with it
+		origins := map[string]bool{}
+		for _, lv := range lvs {
+			if source, ok := getTagValue(lv.Tags, ELVM_SOURCE_TAG_PREFIX); ok && hasTag(lv.Tags, ELVM_SNAPSHOT_TAG) {
+				origins[source] = true
+			}
+		}
+
+		for _, lv := range lvs {
+			if !hasTag(lv.Tags, ELVM_TAG) {
+				continue
+			}
+
+			// Volumes being sanitized count as in use until that finishes
+			// Note: The time is kept on the volume itself, so that it survives restarts.
+			if isSanitizing(lv) || collector.isInUse(lv) {
+				collector.setLastUsed(ctx, lv, now)
+				continue
+			}
+
+			if origins[lv.Name] {
+				continue
+			}
+
+			// Volumes that were never seen in use are idle since they were created
+			idleSince, ok := getTagTime(lv, ELVM_LAST_USED_TAG_PREFIX)
+			if !ok {
+				idleSince, ok = getTagTime(lv, ELVM_CREATED_TAG_PREFIX)
+			}
+			if !ok {
+				// Start the clock for volumes that predate both tags
+				collector.setLastUsed(ctx, lv, now)
+				continue
+			}
+
+			// Records can be up to a tenth of the TTL behind, so allow for that
+			if now.Sub(idleSince) < collector.ttl + collector.ttl / 10 {
+				continue
+			}
+
+			collector.handleOrphan(ctx, lv, now.Sub(idleSince))
+		}
+	}
+}
+
+// Records when a volume was last seen in use, replacing any earlier record
+// Note: Every record rewrites the metadata of the whole volume group, so records
+// are only refreshed once they are a tenth of the TTL old. Dry runs never write.
+func (collector *garbageCollector) setLastUsed(ctx context.Context, logicalVolume *parser.LV, now time.Time) {
+	if collector.dryRun || !collector.isLastUsedStale(logicalVolume, now) {
+		return
+	}
+
+	remove := []string{}
+	if value, ok := getTagValue(logicalVolume.Tags, ELVM_LAST_USED_TAG_PREFIX); ok {
+		remove = append(remove, ELVM_LAST_USED_TAG_PREFIX + value)
+	}
+
+	add := []string{fmt.Sprintf("%s%d", ELVM_LAST_USED_TAG_PREFIX, now.Unix())}
+	if output, err := retagLogicalVolume(ctx, logicalVolume, add, remove); err != nil {
+		log.Println(
+			fmt.Sprintf(
+				"[WARN] Could not record when volume '%s' was last used: %s | %s",
+				getVolumeId(logicalVolume),
+				output,
+				err.Error(),
+			),
+		)
+	}
+}
+
+func (collector *garbageCollector) isLastUsedStale(logicalVolume *parser.LV, now time.Time) bool {
+	lastUsed, ok := getTagTime(logicalVolume, ELVM_LAST_USED_TAG_PREFIX)
+	return !ok || now.Sub(lastUsed) >= collector.ttl / 10
+}
+
+// Note: Any mount, bind mount or open dm-crypt mapping keeps the LV open, so
+// that covers every way that ELVM uses a volume.
+func (collector *garbageCollector) isInUse(logicalVolume *parser.LV) bool {
+	if logicalVolume.Attributes.Open == parser.VolumeOpenIsOpen {
+		return true
+	}
+
+	if isEncrypted(logicalVolume) && isCryptMappingOpen(logicalVolume) {
+		return true
+	}
+
+	info, err := getDeviceInfo(getDevicePath(logicalVolume))
+	return err != nil || len(info.MountPoints) != 0
+}
+
+func (collector *garbageCollector) handleOrphan(ctx context.Context, logicalVolume *parser.LV, idle time.Duration) {
+	name, _ := getTagValue(logicalVolume.Tags, ELVM_NAME_TAG_PREFIX)
+
+	// Only the CO knows whether a regular volume is still claimed
+	if !hasTag(logicalVolume.Tags, ELVM_INLINE_TAG) {
+		log.Println(
+			fmt.Sprintf(
+				"[WARN] Volume '%s' (%s) has been unused for %s. Delete it through the CO if it is no longer needed.",
+				getVolumeId(logicalVolume),
+				name,
+				idle.Round(time.Second),
+			),
+		)
+		return
+	}
+
+	// Give operators a way to keep a volume around for inspection
+	if hasTag(logicalVolume.Tags, commands.ProtectedTagName) {
+		log.Println(
+			fmt.Sprintf(
+				"[INFO] Keeping orphaned inline volume '%s' (%s), since it is tagged '%s'",
+				getVolumeId(logicalVolume),
+				name,
+				commands.ProtectedTagName,
+			),
+		)
+		return
+	}
+
+	if collector.dryRun {
+		log.Println(
+			fmt.Sprintf(
+				"[WARN] Found orphaned inline volume '%s' (%s), unused for %s. Not removing it, since this is a dry run.",
+				getVolumeId(logicalVolume),
+				name,
+				idle.Round(time.Second),
+			),
+		)
+		return
+	}
+
+	log.Println(
+		fmt.Sprintf(
+			"[WARN] Removing orphaned inline volume '%s' (%s), unused for %s",
+			getVolumeId(logicalVolume),
+			name,
+			idle.Round(time.Second),
+		),
+	)
+
+	policy := getRemovalSanitizePolicy(collector.deviceClasses.get(), logicalVolume)
+	if output, err := collector.sanitizer.remove(ctx, logicalVolume, policy); err != nil {
+		log.Println(
+			fmt.Sprintf(
+				"[WARN] Could not remove orphaned inline volume '%s': %s | %s",
+				getVolumeId(logicalVolume),
+				output,
+				err.Error(),
+			),
+		)
+	}
+}
+
+// Reads a tag holding a unix timestamp
+func getTagTime(logicalVolume *parser.LV, prefix string) (time.Time, bool) {
+	value, ok := getTagValue(logicalVolume.Tags, prefix)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(seconds, 0), true
+}
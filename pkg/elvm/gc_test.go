@@ -0,0 +1,85 @@
+package elvm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/lvmd/parser"
+)
+
+func TestGetTagTime(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		expected time.Time
+		found bool
+	}{
+		{
+			name: "recorded",
+			tags: []string{ELVM_TAG, ELVM_LAST_USED_TAG_PREFIX + "1700000000"},
+			expected: time.Unix(1700000000, 0),
+			found: true,
+		},
+		{
+			name: "missing",
+			tags: []string{ELVM_TAG, ELVM_CREATED_TAG_PREFIX + "1700000000"},
+		},
+		{
+			name: "not a number",
+			tags: []string{ELVM_LAST_USED_TAG_PREFIX + "yesterday"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, found := getTagTime(&parser.LV{Tags: test.tags}, ELVM_LAST_USED_TAG_PREFIX)
+			if found != test.found {
+				t.Fatalf("expected found to be %t, got %t", test.found, found)
+			}
+
+			if !value.Equal(test.expected) {
+				t.Errorf("expected %s, got %s", test.expected, value)
+			}
+		})
+	}
+}
+
+func TestIsLastUsedStale(t *testing.T) {
+	collector := &garbageCollector{ttl: 10 * time.Hour}
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name string
+		tags []string
+		expected bool
+	}{
+		{
+			name: "never recorded",
+			tags: []string{ELVM_TAG, ELVM_CREATED_TAG_PREFIX + "1700000000"},
+			expected: true,
+		},
+		{
+			name: "recent",
+			tags: []string{ELVM_TAG, ELVM_LAST_USED_TAG_PREFIX + "1699999000"},
+			expected: false,
+		},
+		{
+			name: "a tenth of the ttl old",
+			tags: []string{ELVM_TAG, ELVM_LAST_USED_TAG_PREFIX + "1699996400"},
+			expected: true,
+		},
+		{
+			name: "unreadable",
+			tags: []string{ELVM_TAG, ELVM_LAST_USED_TAG_PREFIX + "yesterday"},
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if stale := collector.isLastUsedStale(&parser.LV{Tags: test.tags}, now); stale != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, stale)
+			}
+		})
+	}
+}
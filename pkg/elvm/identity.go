@@ -4,11 +4,10 @@ import (
 	"context"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/google/lvmd/parser"
 )
 
 type elvmIdentityServer struct {
-	volumeGroup *parser.VG
+	deviceClasses *deviceClassStore
 }
 
 // GetPluginInfo returns metadata of the plugin
@@ -30,6 +29,20 @@ func (d *elvmIdentityServer) GetPluginCapabilities(ctx context.Context, req *csi
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}, nil
 }
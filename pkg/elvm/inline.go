@@ -0,0 +1,430 @@
+package elvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/lvmd/commands"
+	"github.com/google/lvmd/parser"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Inline ephemeral volumes are declared in a pod spec and never go through the
+// controller, so they are created when published and removed when unpublished.
+// Note: Volume IDs of inline volumes are made up by the CO and can be longer
+// than LVM allows, so the LV is named after a hash of the ID instead.
+func getInlineVolumeName(volumeId string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(volumeId))
+
+	return fmt.Sprintf("elvm-inline-%016x", hash.Sum64())
+}
+
+// Looks for the inline volume with the given ID in every managed volume group,
+// returning it along with the other volumes of its volume group
+func (server *elvmNodeServer) findInlineVolume(ctx context.Context, volumeId string) (*parser.LV, []*parser.LV, error) {
+	name := getInlineVolumeName(volumeId)
+	for _, vg := range server.deviceClasses.get().getAllVolumeGroups() {
+		lvs, err := getCurrentLVs(ctx, vg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		logicalVolume := findLogicalVolume(lvs, name)
+		if logicalVolume != nil && hasTag(logicalVolume.Tags, ELVM_INLINE_TAG) {
+			return logicalVolume, lvs, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+func (server *elvmNodeServer) publishInlineVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	// Make sure that we have a target path
+	if len(request.TargetPath) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] NodePublishVolume Target path must be provided.",
+		)
+	}
+
+	// Make sure that we have been given a capability that we support
+	if err := checkVolumeCapability(request.VolumeCapability, server.allowMultiNode); err != nil {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			fmt.Sprintf("[ERROR] NodePublishVolume %s", err.Error()),
+		)
+	}
+
+	// Note: Pods can only ask for filesystems inline
+	mountInfo := request.VolumeCapability.GetMount()
+	if mountInfo == nil {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] NodePublishVolume Inline ephemeral volumes must be mounted.",
+		)
+	}
+
+	// Encryption needs secrets at staging, which inline volumes never go through
+	if encrypted, ok := request.VolumeContext[VOLUME_CONTEXT_ENCRYPTED]; ok && encrypted != "false" {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] NodePublishVolume Inline ephemeral volumes cannot be encrypted.",
+		)
+	}
+
+	// Get the requested device class
+	class, err := server.deviceClasses.get().getDeviceClass(request.VolumeContext[VOLUME_CONTEXT_DEVICE_CLASS])
+	if err != nil {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf("[ERROR] NodePublishVolume %s", err.Error()),
+		)
+	}
+
+	if !class.allowsAccessMode(request.VolumeCapability.AccessMode.Mode) {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf(
+				"[ERROR] NodePublishVolume Device class '%s' does not allow access mode %s.",
+				class.name,
+				request.VolumeCapability.AccessMode.Mode,
+			),
+		)
+	}
+
+	// Make sure that we know how big the volume should be
+	sizeAttribute, ok := request.VolumeContext[VOLUME_ATTRIBUTE_SIZE]
+	if !ok {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf("[ERROR] NodePublishVolume Inline ephemeral volumes must set the '%s' attribute.", VOLUME_ATTRIBUTE_SIZE),
+		)
+	}
+
+	size, err := parseSize(sizeAttribute)
+	if err != nil {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			fmt.Sprintf("[ERROR] NodePublishVolume %s", err.Error()),
+		)
+	}
+
+	// Reuse the volume if an earlier call already created it
+	logicalVolume, _, err := server.findInlineVolume(ctx, request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodePublishVolume Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Data from before a reboot must never come back
+	if logicalVolume != nil && server.previousBootPolicy != PREVIOUS_BOOT_KEEP && isFromPreviousBoot(logicalVolume, server.bootId) {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			fmt.Sprintf("[ERROR] NodePublishVolume Inline volume '%s' is from an earlier boot. Refusing to publish it.", request.VolumeId),
+		)
+	}
+
+	created := false
+	if logicalVolume == nil {
+		logicalVolume, err = server.createInlineVolume(ctx, class, request.VolumeId, size)
+		if err != nil {
+			return nil, err
+		}
+
+		created = true
+	}
+
+	// Zero-filling takes a while, so the volume can't be published until it is done
+	if isSanitizing(logicalVolume) {
+		return nil, status.Error(
+			codes.Unavailable,
+			fmt.Sprintf("[ERROR] NodePublishVolume Inline volume '%s' is still being sanitized.", request.VolumeId),
+		)
+	}
+
+	// Make sure that the volume isn't mounted already
+	// Note: The spec says that this should pass
+	// https://github.com/container-storage-interface/spec/blob/master/spec.md#nodepublishvolume
+	mounted, err := isMountPoint(request.TargetPath)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodePublishVolume Could not check mounts for '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	if mounted {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// Don't leave behind a volume that nothing will ever unpublish
+	if err := server.mountInlineVolume(logicalVolume, class, request); err != nil {
+		if created {
+			policy := getSanitizePolicy(class, SANITIZE_ON_DELETE, false)
+			if output, removeErr := server.sanitizer.remove(ctx, logicalVolume, policy); removeErr != nil {
+				log.Println(
+					fmt.Sprintf(
+						"[WARN] Could not remove inline volume '%s' after failing to publish it: %s | %s",
+						logicalVolume.Name,
+						output,
+						removeErr.Error(),
+					),
+				)
+			}
+		}
+
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodePublishVolume Could not publish inline volume '%s': %s", request.VolumeId, err.Error()),
+		)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// Creates an inline volume in the first volume group of the class that has room
+// Note: Inline volumes are always thick, since the node has no view of how much
+// a thin pool has been overprovisioned.
+func (server *elvmNodeServer) createInlineVolume(ctx context.Context, class *deviceClass, volumeId string, size uint64) (*parser.LV, error) {
+	candidates := []*placementCandidate{}
+	for _, vg := range class.volumeGroups {
+		current, err := getCurrentVG(ctx, vg)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] NodePublishVolume Could not get volume group info: %s", err.Error()),
+			)
+		}
+
+		var available uint64
+		if current.FreeSize > class.reserve {
+			available = current.FreeSize - class.reserve
+		}
+
+		candidates = append(candidates, &placementCandidate{
+			vg: current,
+			available: available,
+		})
+	}
+
+	for _, candidate := range server.deviceClasses.get().orderCandidates(class, candidates) {
+		// LVM allocates whole extents, so round up
+		extentSize, err := getExtentSize(ctx, candidate.vg)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] NodePublishVolume Could not get extent size of volume group: %s", err.Error()),
+			)
+		}
+
+		capacity := size
+		if extentSize != 0 && capacity % extentSize != 0 {
+			capacity += extentSize - capacity % extentSize
+		}
+
+		if capacity > candidate.available {
+			continue
+		}
+
+		name := getInlineVolumeName(volumeId)
+		tags := []string{
+			ELVM_TAG,
+			ELVM_INLINE_TAG,
+			ELVM_NAME_TAG_PREFIX + volumeId,
+			ELVM_CLASS_TAG_PREFIX + class.name,
+			fmt.Sprintf("%s%d", ELVM_CREATED_TAG_PREFIX, time.Now().Unix()),
+		}
+		if server.bootId != "" {
+			tags = append(tags, ELVM_BOOT_TAG_PREFIX + server.bootId)
+		}
+
+		// New extents can still hold whatever the last tenant left in them
+		sanitize := getSanitizePolicy(class, SANITIZE_ON_CREATE, false)
+		if sanitize == SANITIZE_ZERO {
+			tags = append(tags, ELVM_SANITIZE_TAG_PREFIX + sanitize)
+		}
+
+		log.Println(
+			fmt.Sprintf(
+				"[INFO] Creating inline volume '%s' in volume group '%s'",
+				name,
+				candidate.vg.Name,
+			),
+		)
+
+		var output string
+		if class.stripes > 1 {
+			output, err = createStripedLogicalVolume(ctx, candidate.vg.Name, name, capacity, class.stripes, class.stripeSize, tags)
+		} else {
+			output, err = commands.CreateLV(ctx, candidate.vg.Name, name, capacity, 0, tags)
+		}
+
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] NodePublishVolume Could not create inline volume: %s | %s", output, err.Error()),
+			)
+		}
+
+		lvs, err := getCurrentLVs(ctx, candidate.vg)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] NodePublishVolume Could not list logical volumes: %s", err.Error()),
+			)
+		}
+
+		logicalVolume := findLogicalVolume(lvs, name)
+		if logicalVolume == nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] NodePublishVolume Could not find inline volume after creating it: %s", name),
+			)
+		}
+
+		if err := server.sanitizer.sanitizeNew(ctx, logicalVolume, sanitize); err != nil {
+			policy := getSanitizePolicy(class, SANITIZE_ON_DELETE, false)
+			if output, removeErr := server.sanitizer.remove(ctx, logicalVolume, policy); removeErr != nil {
+				log.Println(
+					fmt.Sprintf(
+						"[WARN] Could not remove inline volume '%s' after failing to sanitize it: %s | %s",
+						name,
+						output,
+						removeErr.Error(),
+					),
+				)
+			}
+
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] NodePublishVolume Could not sanitize inline volume: %s", err.Error()),
+			)
+		}
+
+		return logicalVolume, nil
+	}
+
+	return nil, status.Error(
+		codes.ResourceExhausted,
+		fmt.Sprintf(
+			"[ERROR] NodePublishVolume Not enough space available in device class '%s' for inline volume of size %d",
+			class.name,
+			size,
+		),
+	)
+}
+
+// Formats an inline volume, if needed, and mounts it straight to the target
+func (server *elvmNodeServer) mountInlineVolume(logicalVolume *parser.LV, class *deviceClass, request *csi.NodePublishVolumeRequest) error {
+	mountInfo := request.VolumeCapability.GetMount()
+	fsType := class.fsType
+	if mountInfo.FsType != "" {
+		fsType = mountInfo.FsType
+	}
+
+	info, err := getVolumeInfo(logicalVolume)
+	if err != nil {
+		return err
+	}
+
+	if info.FsType != fsType {
+		// Never format over data that we did not put there
+		if info.FsType != "" {
+			return errors.New(fmt.Sprintf("Volume contains '%s' instead of '%s'. Refusing to format it.", info.FsType, fsType))
+		}
+
+		log.Println(
+			fmt.Sprintf(
+				"[INFO] Formatting drive '%s' with fs '%s'",
+				logicalVolume.Name,
+				fsType,
+			),
+		)
+
+		if err := formatLogicalVolume(logicalVolume, fsType, class.mkfsOptions); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(request.TargetPath, 0750); err != nil {
+		return err
+	}
+
+	// Note: Options requested by the CO come last so that they take precedence
+	mountOptions := append(append([]string{}, class.mountOptions...), mountInfo.MountFlags...)
+	if request.Readonly || isReadOnlyAccessMode(request.VolumeCapability) {
+		mountOptions = append(mountOptions, "ro")
+	}
+
+	return mountLogicalVolume(logicalVolume, mountOptions, request.TargetPath, fsType)
+}
+
+// Unmounts an inline volume and removes it for good
+func (server *elvmNodeServer) unpublishInlineVolume(ctx context.Context, logicalVolume *parser.LV, request *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	mounted, err := isMountPoint(request.TargetPath)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodeUnpublishVolume Could not check mounts for '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	if mounted {
+		if err = unmountLogicalVolume(request.TargetPath); err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodeUnpublishVolume Could not unmount inline volume '%s': %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
+	}
+
+	// An earlier call already handed the volume off to be sanitized and removed
+	if !hasTag(logicalVolume.Tags, ELVM_TAG) {
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	log.Println(
+		fmt.Sprintf(
+			"[INFO] Removing inline volume '%s'",
+			logicalVolume.Name,
+		),
+	)
+
+	policy := getRemovalSanitizePolicy(server.deviceClasses.get(), logicalVolume)
+	if output, err := server.sanitizer.remove(ctx, logicalVolume, policy); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodeUnpublishVolume Could not remove inline volume '%s': %s | %s",
+				request.VolumeId,
+				output,
+				err.Error(),
+			),
+		)
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
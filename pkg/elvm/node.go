@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"syscall"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/google/lvmd/parser"
@@ -14,14 +16,161 @@ import (
 )
 
 type elvmNodeServer struct {
-	volumeGroup *parser.VG
+	deviceClasses *deviceClassStore
+	allowMultiNode bool
 	nodeId string
-	fsType string
+	bootId string
+	previousBootPolicy string
+	sanitizer *sanitizer
 }
 
 func (server *elvmNodeServer) NodeExpandVolume(ctx context.Context, request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	log.Println("NODE: EXPAND_VOLUME")
-	return nil, nil
+	// Make sure that we have a volume ID
+	if len(request.VolumeId) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] NodeExpandVolume Volume ID must be provided.",
+		)
+	}
+
+	// Make sure that we have a volume path
+	if len(request.VolumePath) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] NodeExpandVolume Volume path must be provided.",
+		)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] NodeExpandVolume Could not find requested logical volume: %s", err.Error()),
+		)
+	}
+
+	// Get all of the logical volumes
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodeExpandVolume Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	// Make sure that we have the requested volume
+	logicalVolume := findLogicalVolume(lvs, volumeName)
+	if logicalVolume == nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] NodeExpandVolume Could not find requested logical volume: %s", request.VolumeId),
+		)
+	}
+
+	// Make sure that the volume is managed by ELVM
+	if !hasTag(logicalVolume.Tags, ELVM_TAG) {
+		return nil, status.Error(
+			codes.Aborted,
+			"[ERROR] NodeExpandVolume Found volume to expand but it is not managed by ELVM. Aborting.",
+		)
+	}
+
+	// Make sure that the controller has actually grown the volume
+	if request.CapacityRange != nil && request.CapacityRange.RequiredBytes > int64(logicalVolume.Size) {
+		return nil, status.Error(
+			codes.OutOfRange,
+			fmt.Sprintf(
+				"[ERROR] NodeExpandVolume Volume '%s' is smaller than requested. Requested (%d) > Actual (%d)",
+				request.VolumeId,
+				request.CapacityRange.RequiredBytes,
+				logicalVolume.Size,
+			),
+		)
+	}
+
+	// Encrypted volumes are used through their mapping, which has to grow first
+	if isEncrypted(logicalVolume) && isCryptMappingOpen(logicalVolume) {
+		if err := resizeEncryptedVolume(ctx, logicalVolume); err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodeExpandVolume Could not grow encrypted mapping of volume '%s': %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
+	}
+
+	// Block volumes have no filesystem to grow
+	if request.VolumeCapability != nil && request.VolumeCapability.GetBlock() != nil {
+		return &csi.NodeExpandVolumeResponse{
+			CapacityBytes: int64(logicalVolume.Size),
+		}, nil
+	}
+
+	// Extract any needed info from the volume
+	info, err := getVolumeInfo(logicalVolume)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodeExpandVolume Could not get volume info for '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	// Find the staged mount, falling back to the published path if needed
+	mountPoint := ""
+	for _, mount := range info.MountPoints {
+		if mount == request.StagingTargetPath {
+			mountPoint = mount
+			break
+		}
+
+		if mount == request.VolumePath {
+			mountPoint = mount
+		}
+	}
+
+	if mountPoint == "" {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			fmt.Sprintf(
+				"[ERROR] NodeExpandVolume Volume '%s' is not mounted at '%s'. Was the staging step skipped?",
+				request.VolumeId,
+				request.VolumePath,
+			),
+		)
+	}
+
+	log.Println(
+		fmt.Sprintf(
+			"[INFO] Growing fs '%s' on logical volume '%s' mounted at '%s'",
+			info.FsType,
+			logicalVolume.Name,
+			mountPoint,
+		),
+	)
+
+	// Grow the filesystem to fill the volume
+	if err := growFilesystem(logicalVolume, info.FsType, mountPoint); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodeExpandVolume Could not grow filesystem on volume '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: int64(logicalVolume.Size),
+	}, nil
 }
 
 func (server *elvmNodeServer) NodeGetCapabilities(ctx context.Context, reqeust *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -39,6 +188,10 @@ func (server *elvmNodeServer) NodeGetCapabilities(ctx context.Context, reqeust *
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
 			toCapability(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME),
+			toCapability(csi.NodeServiceCapability_RPC_EXPAND_VOLUME),
+			toCapability(csi.NodeServiceCapability_RPC_GET_VOLUME_STATS),
+			toCapability(csi.NodeServiceCapability_RPC_VOLUME_CONDITION),
+			toCapability(csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER),
 		},
 	}, nil
 }
@@ -46,12 +199,157 @@ func (server *elvmNodeServer) NodeGetCapabilities(ctx context.Context, reqeust *
 func (server *elvmNodeServer) NodeGetInfo(ctx context.Context, request *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	return &csi.NodeGetInfoResponse{
 		NodeId: server.nodeId,
+		AccessibleTopology: getNodeTopology(server.nodeId),
 	}, nil
 }
 
 func (server *elvmNodeServer) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	log.Println("NODE: GET_VOLUME_STATS")
-	return nil, nil
+	// Make sure that we have a volume ID
+	if len(request.VolumeId) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] NodeGetVolumeStats Volume ID must be provided.",
+		)
+	}
+
+	// Make sure that we have a volume path
+	if len(request.VolumePath) == 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"[ERROR] NodeGetVolumeStats Volume path must be provided.",
+		)
+	}
+
+	// Make sure that the volume path exists
+	pathInfo, err := os.Stat(request.VolumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] NodeGetVolumeStats Volume path does not exist: %s", request.VolumePath),
+		)
+	} else if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodeGetVolumeStats Could not stat volume path '%s': %s", request.VolumePath, err.Error()),
+		)
+	}
+
+	// Inline ephemeral volumes are only known by the ID that the CO made up
+	logicalVolume, lvs, err := server.findInlineVolume(ctx, request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodeGetVolumeStats Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	if logicalVolume == nil {
+		// Find the volume group that holds the volume
+		volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+		if err != nil {
+			return nil, status.Error(
+				codes.NotFound,
+				fmt.Sprintf("[ERROR] NodeGetVolumeStats Could not find requested logical volume: %s", err.Error()),
+			)
+		}
+
+		// Get all of the logical volumes
+		lvs, err = getCurrentLVs(ctx, volumeGroup)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf("[ERROR] NodeGetVolumeStats Could not list logical volumes: %s", err.Error()),
+			)
+		}
+
+		logicalVolume = findLogicalVolume(lvs, volumeName)
+	}
+
+	// A missing volume is reported as a condition so that kubelet can surface it
+	if logicalVolume == nil || !hasTag(logicalVolume.Tags, ELVM_TAG) {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message: fmt.Sprintf("Could not find ELVM logical volume: %s", request.VolumeId),
+			},
+		}, nil
+	}
+
+	// Check the health of the volume itself
+	condition := getVolumeCondition(logicalVolume, lvs)
+
+	// Block volumes are bound directly to a device node, so just report the raw size
+	if pathInfo.Mode() & os.ModeDevice != 0 {
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: int64(logicalVolume.Size),
+					Unit: csi.VolumeUsage_BYTES,
+				},
+			},
+			VolumeCondition: condition,
+		}, nil
+	}
+
+	// Make sure that the path is actually a mount of the volume
+	info, err := getVolumeInfo(logicalVolume)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodeGetVolumeStats Could not get volume info for '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	hasMount := false
+	for _, mount := range info.MountPoints {
+		if mount == request.VolumePath {
+			hasMount = true
+			break
+		}
+	}
+
+	if !hasMount && !condition.Abnormal {
+		condition = &csi.VolumeCondition{
+			Abnormal: true,
+			Message: fmt.Sprintf("Volume path '%s' is not a mount point of '%s'", request.VolumePath, request.VolumeId),
+		}
+	}
+
+	// Get the actual usage from the filesystem
+	var stats syscall.Statfs_t
+	if err := syscall.Statfs(request.VolumePath, &stats); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodeGetVolumeStats Could not statfs volume path '%s': %s",
+				request.VolumePath,
+				err.Error(),
+			),
+		)
+	}
+
+	blockSize := uint64(stats.Bsize)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Available: int64(stats.Bavail * blockSize),
+				Total: int64(stats.Blocks * blockSize),
+				Used: int64((stats.Blocks - stats.Bfree) * blockSize),
+				Unit: csi.VolumeUsage_BYTES,
+			},
+			{
+				Available: int64(stats.Ffree),
+				Total: int64(stats.Files),
+				Used: int64(stats.Files - stats.Ffree),
+				Unit: csi.VolumeUsage_INODES,
+			},
+		},
+		VolumeCondition: condition,
+	}, nil
 }
 
 func (server *elvmNodeServer) NodePublishVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -63,6 +361,11 @@ func (server *elvmNodeServer) NodePublishVolume(ctx context.Context, request *cs
 		)
 	}
 
+	// Inline ephemeral volumes are created right here and are never staged
+	if request.VolumeContext[VOLUME_CONTEXT_EPHEMERAL] == "true" {
+		return server.publishInlineVolume(ctx, request)
+	}
+
 	// Make sure that we have a staging path
 	if len(request.StagingTargetPath) == 0 {
 		return nil, status.Error(
@@ -79,16 +382,25 @@ func (server *elvmNodeServer) NodePublishVolume(ctx context.Context, request *cs
 		)
 	}
 
-	// Make sure that we have been given the capability that we require
-	if request.VolumeCapability == nil || request.VolumeCapability.AccessMode.Mode != SUPPORTED_CAPABILITY {
+	// Make sure that we have been given a capability that we support
+	if err := checkExistingVolumeCapability(request.VolumeCapability, server.allowMultiNode); err != nil {
 		return nil, status.Error(
 			codes.FailedPrecondition,
-			"[ERROR] NodePublishVolume Only `multi_node_multi_writer` is allowed as a volume capability.",
+			fmt.Sprintf("[ERROR] NodePublishVolume %s", err.Error()),
+		)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] NodePublishVolume Could not find requested logical volume: %s", err.Error()),
 		)
 	}
 
 	// Get all of the logical volumes
-	lvs, err := getCurrentLVs(ctx, server.volumeGroup)
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
 	if err != nil {
 		return nil, status.Error(
 			codes.Internal,
@@ -99,7 +411,7 @@ func (server *elvmNodeServer) NodePublishVolume(ctx context.Context, request *cs
 	// Make sure that we have the requested volume
 	var logicalVolume *parser.LV
 	for _, lv := range lvs {
-		if lv.Name == request.VolumeId {
+		if lv.Name == volumeName {
 			logicalVolume = lv
 			break
 		}
@@ -128,6 +440,22 @@ func (server *elvmNodeServer) NodePublishVolume(ctx context.Context, request *cs
 		)
 	}
 
+	// Encrypted volumes can only be used once staging has opened their mapping
+	if isEncrypted(logicalVolume) && !isCryptMappingOpen(logicalVolume) {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			fmt.Sprintf(
+				"[ERROR] NodePublishVolume Encrypted volume '%s' is not open. Was the staging step skipped?",
+				request.VolumeId,
+			),
+		)
+	}
+
+	// Block volumes skip the filesystem entirely and bind the device node instead
+	if request.VolumeCapability.GetBlock() != nil {
+		return server.publishBlockVolume(logicalVolume, request)
+	}
+
 	// Extract any needed info from the volume
 	info, err := getVolumeInfo(logicalVolume)
 	if err != nil {
@@ -151,10 +479,18 @@ func (server *elvmNodeServer) NodePublishVolume(ctx context.Context, request *cs
 	}
 
 	// Get formatting info
+	class, err := server.deviceClasses.get().getDeviceClassOfVolume(logicalVolume)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodePublishVolume Could not find device class of volume: %s", err.Error()),
+		)
+	}
+
 	mountInfo := request.VolumeCapability.GetMount()
 	var requestedFsType string
 	if mountInfo.FsType == "" {
-		requestedFsType = server.fsType
+		requestedFsType = class.fsType
 	} else {
 		requestedFsType = mountInfo.FsType
 	}
@@ -196,6 +532,94 @@ func (server *elvmNodeServer) NodePublishVolume(ctx context.Context, request *cs
 		)
 	}
 
+	// Reader-only volumes should not be writable by the workload
+	if request.Readonly || isReadOnlyAccessMode(request.VolumeCapability) {
+		if err = remountReadOnly(request.TargetPath); err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodePublishVolume Could not make volume '%s' read-only: %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (server *elvmNodeServer) publishBlockVolume(logicalVolume *parser.LV, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	// Make sure that the volume isn't bound already
+	// Note: The spec says that this should pass
+	// https://github.com/container-storage-interface/spec/blob/master/spec.md#nodepublishvolume
+	mounted, err := isMountPoint(request.TargetPath)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodePublishVolume Could not check mounts for '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	if mounted {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// We need to create the target file, so do so here
+	if err := os.MkdirAll(filepath.Dir(request.TargetPath), 0750); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodePublishVolume Cannot create target directory for %s: %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	targetFile, err := os.OpenFile(request.TargetPath, os.O_CREATE, 0660)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodePublishVolume Cannot create target file for %s: %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+	targetFile.Close()
+
+	// Bind mount the device
+	if err = bindBlockDevice(logicalVolume, request.TargetPath); err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodePublishVolume Could not bind mount block device '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	// Reader-only volumes should not be writable by the workload
+	if request.Readonly || isReadOnlyAccessMode(request.VolumeCapability) {
+		if err = remountReadOnly(request.TargetPath); err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodePublishVolume Could not make block device '%s' read-only: %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
+	}
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -216,16 +640,25 @@ func (server *elvmNodeServer) NodeStageVolume(ctx context.Context, request *csi.
 		)
 	}
 
-	// Make sure that we have been given the capability that we require
-	if request.VolumeCapability == nil || request.VolumeCapability.AccessMode.Mode != SUPPORTED_CAPABILITY {
+	// Make sure that we have been given a capability that we support
+	if err := checkExistingVolumeCapability(request.VolumeCapability, server.allowMultiNode); err != nil {
 		return nil, status.Error(
 			codes.FailedPrecondition,
-			"[ERROR] NodeStageVolume Only `multi_node_multi_writer` is allowed as a volume capability.",
+			fmt.Sprintf("[ERROR] NodeStageVolume %s", err.Error()),
+		)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] NodeStageVolume Could not find requested logical volume: %s", err.Error()),
 		)
 	}
 
 	// Get all of the logical volumes
-	lvs, err := getCurrentLVs(ctx, server.volumeGroup)
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
 	if err != nil {
 		return nil, status.Error(
 			codes.Internal,
@@ -236,7 +669,7 @@ func (server *elvmNodeServer) NodeStageVolume(ctx context.Context, request *csi.
 	// Make sure that we have the requested volume
 	var logicalVolume *parser.LV
 	for _, lv := range lvs {
-		if lv.Name == request.VolumeId {
+		if lv.Name == volumeName {
 			logicalVolume = lv
 			break
 		}
@@ -265,6 +698,68 @@ func (server *elvmNodeServer) NodeStageVolume(ctx context.Context, request *csi.
 		)
 	}
 
+	// Volumes being sanitized still hold someone else's data
+	if isSanitizing(logicalVolume) {
+		return nil, status.Error(
+			codes.Unavailable,
+			fmt.Sprintf("[ERROR] NodeStageVolume Volume '%s' is still being sanitized. Try again later.", request.VolumeId),
+		)
+	}
+
+	// Data from before a reboot must never come back
+	if server.previousBootPolicy != PREVIOUS_BOOT_KEEP && isFromPreviousBoot(logicalVolume, server.bootId) {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			fmt.Sprintf("[ERROR] NodeStageVolume Volume '%s' is from an earlier boot. Refusing to stage it.", request.VolumeId),
+		)
+	}
+
+	// Encrypted volumes must never be written to without their key
+	encryption := getEncryption(logicalVolume)
+	if expected, ok := request.VolumeContext[VOLUME_CONTEXT_ENCRYPTED]; ok && expected != getEncryptionContext(encryption) {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			fmt.Sprintf(
+				"[ERROR] NodeStageVolume Volume '%s' should have encryption '%s', but it has '%s'. Aborting.",
+				request.VolumeId,
+				expected,
+				getEncryptionContext(encryption),
+			),
+		)
+	}
+
+	switch encryption {
+	case ENCRYPTION_LUKS:
+		passphrase := request.Secrets[SECRET_PASSPHRASE]
+		if len(passphrase) == 0 {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				fmt.Sprintf("[ERROR] NodeStageVolume Volume '%s' is encrypted, but no '%s' secret was provided.", request.VolumeId, SECRET_PASSPHRASE),
+			)
+		}
+
+		err = openEncryptedVolume(ctx, logicalVolume, passphrase)
+	case ENCRYPTION_EPHEMERAL:
+		err = openEphemeralVolume(ctx, logicalVolume)
+	}
+
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf(
+				"[ERROR] NodeStageVolume Could not open encrypted volume '%s': %s",
+				request.VolumeId,
+				err.Error(),
+			),
+		)
+	}
+
+	// Block volumes are bound straight from the device node when published, so
+	// there is nothing to format or mount here
+	if request.VolumeCapability.GetBlock() != nil {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	// Extract any needed info from the volume
 	info, err := getVolumeInfo(logicalVolume)
 	if err != nil {
@@ -288,10 +783,18 @@ func (server *elvmNodeServer) NodeStageVolume(ctx context.Context, request *csi.
 	}
 
 	// Get formatting info
+	class, err := server.deviceClasses.get().getDeviceClassOfVolume(logicalVolume)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodeStageVolume Could not find device class of volume: %s", err.Error()),
+		)
+	}
+
 	mountInfo := request.VolumeCapability.GetMount()
 	var requestedFsType string
 	if mountInfo.FsType == "" {
-		requestedFsType = server.fsType
+		requestedFsType = class.fsType
 	} else {
 		requestedFsType = mountInfo.FsType
 	}
@@ -299,7 +802,7 @@ func (server *elvmNodeServer) NodeStageVolume(ctx context.Context, request *csi.
 	log.Println(
 		fmt.Sprintf(
 			"[INFO] Found logical volume '%s' with fs '%s'",
-			logicalVolume,
+			logicalVolume.Name,
 			info.FsType,
 		),
 	)
@@ -314,7 +817,7 @@ func (server *elvmNodeServer) NodeStageVolume(ctx context.Context, request *csi.
 			),
 		)
 
-		err := formatLogicalVolume(logicalVolume, requestedFsType)
+		err := formatLogicalVolume(logicalVolume, requestedFsType, class.mkfsOptions)
 		if err != nil {
 			return nil, status.Error(
 				codes.Internal,
@@ -328,7 +831,9 @@ func (server *elvmNodeServer) NodeStageVolume(ctx context.Context, request *csi.
 	}
 
 	// Mount the drive to the supplied location
-	if err = mountLogicalVolume(logicalVolume, mountInfo.MountFlags, request.StagingTargetPath, requestedFsType); err != nil {
+	// Note: Options requested by the CO come last so that they take precedence
+	mountOptions := append(append([]string{}, class.mountOptions...), mountInfo.MountFlags...)
+	if err = mountLogicalVolume(logicalVolume, mountOptions, request.StagingTargetPath, requestedFsType); err != nil {
 		return nil, status.Error(
 			codes.Internal,
 			fmt.Sprintf(
@@ -359,8 +864,30 @@ func (server *elvmNodeServer) NodeUnpublishVolume(ctx context.Context, request *
 		)
 	}
 
+	// Inline ephemeral volumes are removed as soon as they are unpublished
+	inlineVolume, _, err := server.findInlineVolume(ctx, request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.Internal,
+			fmt.Sprintf("[ERROR] NodeUnpublishVolume Could not list logical volumes: %s", err.Error()),
+		)
+	}
+
+	if inlineVolume != nil {
+		return server.unpublishInlineVolume(ctx, inlineVolume, request)
+	}
+
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] NodePublishVolume Could not find requested logical volume: %s", err.Error()),
+		)
+	}
+
 	// Get all of the logical volumes
-	lvs, err := getCurrentLVs(ctx, server.volumeGroup)
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
 	if err != nil {
 		return nil, status.Error(
 			codes.Internal,
@@ -371,7 +898,7 @@ func (server *elvmNodeServer) NodeUnpublishVolume(ctx context.Context, request *
 	// Make sure that we have the requested volume
 	var logicalVolume *parser.LV
 	for _, lv := range lvs {
-		if lv.Name == request.VolumeId {
+		if lv.Name == volumeName {
 			logicalVolume = lv
 			break
 		}
@@ -401,16 +928,20 @@ func (server *elvmNodeServer) NodeUnpublishVolume(ctx context.Context, request *
 	}
 
 	// Extract any needed info from the volume
-	info, err := getVolumeInfo(logicalVolume)
-	if err != nil {
-		return nil, status.Error(
-			codes.Internal,
-			fmt.Sprintf(
-				"[ERROR] NodeUnpublishVolume Could not get volume info for '%s': %s",
-				request.VolumeId,
-				err.Error(),
-			),
-		)
+	// Note: Encrypted volumes have nothing to report once their mapping is closed
+	info := &VolumeInfo{}
+	if !isEncrypted(logicalVolume) || isCryptMappingOpen(logicalVolume) {
+		info, err = getVolumeInfo(logicalVolume)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodeUnpublishVolume Could not get volume info for '%s': %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
 	}
 
 	// Make sure that the volume isn't mounted already
@@ -424,6 +955,21 @@ func (server *elvmNodeServer) NodeUnpublishVolume(ctx context.Context, request *
 		}
 	}
 
+	// Block volumes are bound from the device node, which lsblk does not report
+	if !hasMount {
+		hasMount, err = isMountPoint(request.TargetPath)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodeUnpublishVolume Could not check mounts for '%s': %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
+	}
+
 	// Exit early if not mounted
 	if !hasMount {
 		return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -441,6 +987,20 @@ func (server *elvmNodeServer) NodeUnpublishVolume(ctx context.Context, request *
 		)
 	}
 
+	// Block volumes are published onto a file that we created, so clean it up
+	if targetInfo, err := os.Stat(request.TargetPath); err == nil && !targetInfo.IsDir() {
+		if err := os.Remove(request.TargetPath); err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodeUnpublishVolume Could not remove target file for '%s': %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -461,8 +1021,17 @@ func (server *elvmNodeServer) NodeUnstageVolume(ctx context.Context, request *cs
 		)
 	}
 
+	// Find the volume group that holds the volume
+	volumeGroup, volumeName, err := server.deviceClasses.get().resolveVolumeId(request.VolumeId)
+	if err != nil {
+		return nil, status.Error(
+			codes.NotFound,
+			fmt.Sprintf("[ERROR] NodeStageVolume Could not find requested logical volume: %s", err.Error()),
+		)
+	}
+
 	// Get all of the logical volumes
-	lvs, err := getCurrentLVs(ctx, server.volumeGroup)
+	lvs, err := getCurrentLVs(ctx, volumeGroup)
 	if err != nil {
 		return nil, status.Error(
 			codes.Internal,
@@ -473,7 +1042,7 @@ func (server *elvmNodeServer) NodeUnstageVolume(ctx context.Context, request *cs
 	// Make sure that we have the requested volume
 	var logicalVolume *parser.LV
 	for _, lv := range lvs {
-		if lv.Name == request.VolumeId {
+		if lv.Name == volumeName {
 			logicalVolume = lv
 			break
 		}
@@ -502,6 +1071,11 @@ func (server *elvmNodeServer) NodeUnstageVolume(ctx context.Context, request *cs
 		)
 	}
 
+	// Encrypted volumes that aren't open can't be staged anywhere
+	if isEncrypted(logicalVolume) && !isCryptMappingOpen(logicalVolume) {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
 	// Extract any needed info from the volume
 	info, err := getVolumeInfo(logicalVolume)
 	if err != nil {
@@ -524,22 +1098,33 @@ func (server *elvmNodeServer) NodeUnstageVolume(ctx context.Context, request *cs
 		}
 	}
 
-	// If the volume wasn't mounted, then pass
-	if !mountFound {
-		return &csi.NodeUnstageVolumeResponse{}, nil
+	// Unmount the drive from the supplied location, if it was mounted there
+	if mountFound {
+		err = unmountLogicalVolume(request.StagingTargetPath)
+		if err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodeStageVolume Could not unmount volume '%s': %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
 	}
 
-	// Unmount the drive from the supplied location
-	err = unmountLogicalVolume(request.StagingTargetPath)
-	if err != nil {
-		return nil, status.Error(
-			codes.Internal,
-			fmt.Sprintf(
-				"[ERROR] NodeStageVolume Could not unmount volume '%s': %s",
-				request.VolumeId,
-				err.Error(),
-			),
-		)
+	// Encrypted volumes are opened when staged, so close them again
+	if isEncrypted(logicalVolume) {
+		if err = closeEncryptedVolume(ctx, logicalVolume); err != nil {
+			return nil, status.Error(
+				codes.Internal,
+				fmt.Sprintf(
+					"[ERROR] NodeStageVolume Could not close encrypted volume '%s': %s",
+					request.VolumeId,
+					err.Error(),
+				),
+			)
+		}
 	}
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
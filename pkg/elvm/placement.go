@@ -0,0 +1,88 @@
+package elvm
+
+import (
+	"sort"
+
+	"github.com/google/lvmd/parser"
+)
+
+// Policies for choosing between the volume groups of a device class
+const (
+	// Prefer the volume group with the most available space
+	PLACEMENT_MOST_FREE = "most-free"
+	// Prefer the volume group with the smallest fraction of its space in use
+	PLACEMENT_LEAST_USED = "least-used"
+	// Take turns between the volume groups, in the order they were configured
+	PLACEMENT_ROUND_ROBIN = "round-robin"
+	// Prefer the volume group with the least available space, keeping the others
+	// free for large volumes
+	PLACEMENT_BINPACK = "binpack"
+)
+
+var SUPPORTED_PLACEMENT_POLICIES = []string{
+	PLACEMENT_MOST_FREE,
+	PLACEMENT_LEAST_USED,
+	PLACEMENT_ROUND_ROBIN,
+	PLACEMENT_BINPACK,
+}
+
+// A volume group that a new volume could be placed in
+type placementCandidate struct {
+	vg *parser.VG
+	// Space left for volumes once the reserve is taken out
+	available uint64
+}
+
+func isPlacementPolicySupported(policy string) bool {
+	for _, supported := range SUPPORTED_PLACEMENT_POLICIES {
+		if policy == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Orders the candidates of a device class from most to least preferred
+// Note: Candidates must be given in the order that the volume groups of the
+// class were configured, so that ties are broken the same way every time.
+func (d *deviceClasses) orderCandidates(class *deviceClass, candidates []*placementCandidate) []*placementCandidate {
+	ordered := make([]*placementCandidate, len(candidates))
+	copy(ordered, candidates)
+
+	switch class.placementPolicy {
+	case PLACEMENT_LEAST_USED:
+		used := func(candidate *placementCandidate) float64 {
+			if candidate.vg.Size == 0 {
+				return 1
+			}
+
+			return float64(candidate.vg.Size - candidate.vg.FreeSize) / float64(candidate.vg.Size)
+		}
+
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return used(ordered[i]) < used(ordered[j])
+		})
+	case PLACEMENT_ROUND_ROBIN:
+		if len(ordered) == 0 {
+			break
+		}
+
+		d.lock.Lock()
+		start := d.nextPlacement[class.name] % len(ordered)
+		d.nextPlacement[class.name] = start + 1
+		d.lock.Unlock()
+
+		ordered = append(ordered[start:], ordered[:start]...)
+	case PLACEMENT_BINPACK:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].available < ordered[j].available
+		})
+	default:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].available > ordered[j].available
+		})
+	}
+
+	return ordered
+}
@@ -0,0 +1,93 @@
+package elvm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/lvmd/parser"
+)
+
+func TestOrderCandidates(t *testing.T) {
+	// Configured in this order: a is the largest but fullest, c is the emptiest
+	newCandidates := func() []*placementCandidate {
+		return []*placementCandidate{
+			{vg: &parser.VG{Name: "a", Size: 1000, FreeSize: 300}, available: 300},
+			{vg: &parser.VG{Name: "b", Size: 400, FreeSize: 100}, available: 100},
+			{vg: &parser.VG{Name: "c", Size: 200, FreeSize: 150}, available: 150},
+		}
+	}
+
+	tests := []struct {
+		policy string
+		// Each entry is one placement in a row
+		expected [][]string
+	}{
+		{
+			policy: PLACEMENT_MOST_FREE,
+			expected: [][]string{{"a", "c", "b"}, {"a", "c", "b"}},
+		},
+		{
+			policy: PLACEMENT_LEAST_USED,
+			expected: [][]string{{"c", "a", "b"}, {"c", "a", "b"}},
+		},
+		{
+			policy: PLACEMENT_BINPACK,
+			expected: [][]string{{"b", "c", "a"}, {"b", "c", "a"}},
+		},
+		{
+			policy: PLACEMENT_ROUND_ROBIN,
+			expected: [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			class := &deviceClass{
+				name: "default",
+				placementPolicy: test.policy,
+			}
+			classes := &deviceClasses{
+				classes: map[string]*deviceClass{class.name: class},
+				defaultClass: class.name,
+				nextPlacement: map[string]int{},
+			}
+
+			for i, expected := range test.expected {
+				candidates := newCandidates()
+				names := []string{}
+				for _, candidate := range classes.orderCandidates(class, candidates) {
+					names = append(names, candidate.vg.Name)
+				}
+
+				if !reflect.DeepEqual(names, expected) {
+					t.Errorf("placement %d: expected %v, got %v", i + 1, expected, names)
+				}
+
+				// The caller's order must be left alone
+				if candidates[0].vg.Name != "a" || candidates[1].vg.Name != "b" || candidates[2].vg.Name != "c" {
+					t.Errorf("placement %d: candidates were reordered in place", i + 1)
+				}
+			}
+		})
+	}
+}
+
+func TestIsPlacementPolicySupported(t *testing.T) {
+	tests := []struct {
+		policy string
+		expected bool
+	}{
+		{PLACEMENT_MOST_FREE, true},
+		{PLACEMENT_LEAST_USED, true},
+		{PLACEMENT_ROUND_ROBIN, true},
+		{PLACEMENT_BINPACK, true},
+		{"", false},
+		{"random", false},
+	}
+
+	for _, test := range tests {
+		if supported := isPlacementPolicySupported(test.policy); supported != test.expected {
+			t.Errorf("'%s': expected %t, got %t", test.policy, test.expected, supported)
+		}
+	}
+}
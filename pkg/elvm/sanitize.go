@@ -0,0 +1,361 @@
+package elvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/google/lvmd/commands"
+	"github.com/google/lvmd/parser"
+)
+
+// Ways of making sure that the next tenant cannot read what was on a volume
+const (
+	SANITIZE_NONE = "none"
+	// Erase filesystem, LUKS and partition table signatures
+	SANITIZE_WIPEFS = "wipefs"
+	// Discard every block, which reads back as zeros on most SSDs
+	SANITIZE_DISCARD = "discard"
+	// Overwrite every block with zeros. This can take a long time, so it always
+	// runs in the background.
+	SANITIZE_ZERO = "zero"
+)
+
+var SUPPORTED_SANITIZE_POLICIES = []string{
+	SANITIZE_NONE,
+	SANITIZE_WIPEFS,
+	SANITIZE_DISCARD,
+	SANITIZE_ZERO,
+}
+
+// When a volume is sanitized
+const (
+	SANITIZE_ON_DELETE = "delete"
+	SANITIZE_ON_CREATE = "create"
+)
+
+var SUPPORTED_SANITIZE_TIMINGS = []string{
+	SANITIZE_ON_DELETE,
+	SANITIZE_ON_CREATE,
+}
+
+// Size of each write when zero-filling
+const ZERO_FILL_CHUNK_SIZE = 4 * 1024 * 1024
+
+// Commands needed by each policy
+var SANITIZE_COMMANDS = map[string]string{
+	SANITIZE_WIPEFS: "wipefs",
+	SANITIZE_DISCARD: "blkdiscard",
+}
+
+// Runs background sanitization, making sure that each volume is only worked on
+// once at a time
+type sanitizer struct {
+	lock sync.Mutex
+	running map[string]bool
+}
+
+func newSanitizer() *sanitizer {
+	return &sanitizer{
+		running: map[string]bool{},
+	}
+}
+
+func isSanitizePolicySupported(policy string) bool {
+	for _, supported := range SUPPORTED_SANITIZE_POLICIES {
+		if policy == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSanitizeTimingSupported(timing string) bool {
+	for _, supported := range SUPPORTED_SANITIZE_TIMINGS {
+		if timing == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Volumes are hidden for as long as they carry this tag
+func isSanitizing(logicalVolume *parser.LV) bool {
+	_, ok := getTagValue(logicalVolume.Tags, ELVM_SANITIZE_TAG_PREFIX)
+	return ok
+}
+
+// Thin pools zero blocks when handing them out, and zero-filling a thin volume
+// would allocate all of it, so only thick volumes are ever sanitized
+func getSanitizePolicy(class *deviceClass, timing string, thin bool) string {
+	if thin || class.sanitizeOn != timing {
+		return SANITIZE_NONE
+	}
+
+	return class.sanitize
+}
+
+// The policy to sanitize an existing volume by before it is removed
+// Note: Snapshots share their data with their origin, so wiping one would only
+// fill up its COW area. They are never sanitized.
+func getRemovalSanitizePolicy(classes *deviceClasses, logicalVolume *parser.LV) string {
+	if hasTag(logicalVolume.Tags, ELVM_SNAPSHOT_TAG) {
+		return SANITIZE_NONE
+	}
+
+	class, err := classes.getDeviceClassOfVolume(logicalVolume)
+	if err != nil {
+		log.Println(
+			fmt.Sprintf(
+				"[WARN] Could not find device class of '%s', so it will not be sanitized: %s",
+				getVolumeId(logicalVolume),
+				err.Error(),
+			),
+		)
+		return SANITIZE_NONE
+	}
+
+	return getSanitizePolicy(class, SANITIZE_ON_DELETE, logicalVolume.Attributes.Type == parser.VolumeTypeThin)
+}
+
+// Sanitizes a volume and then removes it. Volumes that need zero-filling are
+// hidden instead, and removed in the background once that finishes.
+func (s *sanitizer) remove(ctx context.Context, logicalVolume *parser.LV, policy string) (string, error) {
+	// Never wipe what LVM would refuse to remove anyway
+	if hasTag(logicalVolume.Tags, commands.ProtectedTagName) {
+		return "", errors.New("volume is protected")
+	}
+
+	switch policy {
+	case SANITIZE_NONE:
+	case SANITIZE_ZERO:
+		output, err := retagLogicalVolume(ctx, logicalVolume, []string{ELVM_SANITIZE_TAG_PREFIX + policy}, []string{ELVM_TAG})
+		if err != nil {
+			return output, errors.New(fmt.Sprintf("Could not hide logical volume for sanitizing: %s", err.Error()))
+		}
+
+		s.start(logicalVolume, policy, true)
+		return "", nil
+	default:
+		if err := sanitizeLogicalVolume(ctx, logicalVolume, policy); err != nil {
+			return "", err
+		}
+	}
+
+	return commands.RemoveLV(ctx, logicalVolume.VGName, logicalVolume.Name)
+}
+
+// Sanitizes a volume that was just created
+// Note: Volumes that need zero-filling must be created with the sanitize tag,
+// which is removed in the background once that finishes.
+func (s *sanitizer) sanitizeNew(ctx context.Context, logicalVolume *parser.LV, policy string) error {
+	switch policy {
+	case SANITIZE_NONE:
+		return nil
+	case SANITIZE_ZERO:
+		s.start(logicalVolume, policy, false)
+		return nil
+	}
+
+	return sanitizeLogicalVolume(ctx, logicalVolume, policy)
+}
+
+func sanitizeLogicalVolume(ctx context.Context, logicalVolume *parser.LV, policy string) error {
+	device := getDevicePath(logicalVolume)
+	log.Println(
+		fmt.Sprintf(
+			"[INFO] Sanitizing logical volume '%s' by policy '%s'",
+			getVolumeId(logicalVolume),
+			policy,
+		),
+	)
+
+	var err error
+	switch policy {
+	case SANITIZE_NONE:
+		return nil
+	case SANITIZE_WIPEFS:
+		err = runSanitizeCommand(ctx, SANITIZE_COMMANDS[policy], "--all", device)
+	case SANITIZE_DISCARD:
+		err = runSanitizeCommand(ctx, SANITIZE_COMMANDS[policy], device)
+	case SANITIZE_ZERO:
+		err = zeroFill(ctx, device, getVolumeId(logicalVolume))
+	default:
+		err = errors.New(fmt.Sprintf("Unknown sanitize policy '%s'", policy))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Println(
+		fmt.Sprintf(
+			"[INFO] Finished sanitizing logical volume '%s'",
+			getVolumeId(logicalVolume),
+		),
+	)
+
+	return nil
+}
+
+func runSanitizeCommand(ctx context.Context, command string, args ...string) error {
+	// Make sure that we have the needed command
+	if !isCommandAvailable(command) {
+		return errors.New("Could not find command in path: " + command)
+	}
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	return nil
+}
+
+// Overwrites a whole device with zeros, logging every 10% of progress
+func zeroFill(ctx context.Context, device string, name string) error {
+	file, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, ZERO_FILL_CHUNK_SIZE)
+	var written int64
+	nextReport := int64(10)
+	for written < size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := buffer
+		if size - written < int64(len(chunk)) {
+			chunk = chunk[:size - written]
+		}
+
+		count, err := file.Write(chunk)
+		written += int64(count)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Could not zero-fill '%s' after %d bytes: %s", device, written, err.Error()))
+		}
+
+		if percent := written * 100 / size; percent >= nextReport {
+			log.Println(
+				fmt.Sprintf(
+					"[INFO] Zero-filled %d%% of logical volume '%s'",
+					percent,
+					name,
+				),
+			)
+			nextReport = percent / 10 * 10 + 10
+		}
+	}
+
+	return file.Sync()
+}
+
+// Sanitizes a volume in the background, then either removes it or makes it
+// visible again. Volumes that fail keep their tag, so that they stay hidden
+// until the next attempt.
+func (s *sanitizer) start(logicalVolume *parser.LV, policy string, remove bool) {
+	volumeId := getVolumeId(logicalVolume)
+
+	s.lock.Lock()
+	if s.running[volumeId] {
+		s.lock.Unlock()
+		return
+	}
+	s.running[volumeId] = true
+	s.lock.Unlock()
+
+	go func() {
+		defer func() {
+			s.lock.Lock()
+			delete(s.running, volumeId)
+			s.lock.Unlock()
+		}()
+
+		ctx := context.Background()
+		if err := sanitizeLogicalVolume(ctx, logicalVolume, policy); err != nil {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Could not sanitize logical volume '%s'. It stays hidden until the driver restarts: %s",
+					volumeId,
+					err.Error(),
+				),
+			)
+			return
+		}
+
+		var output string
+		var err error
+		if remove {
+			output, err = commands.RemoveLV(ctx, logicalVolume.VGName, logicalVolume.Name)
+		} else {
+			output, err = commands.RemoveTagLV(ctx, logicalVolume.VGName, logicalVolume.Name, []string{ELVM_SANITIZE_TAG_PREFIX + policy})
+		}
+
+		if err != nil {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Could not finish up sanitized logical volume '%s': %s | %s",
+					volumeId,
+					output,
+					err.Error(),
+				),
+			)
+		}
+	}()
+}
+
+// Picks up sanitization that was cut short by the driver stopping
+// Note: Volumes that are still managed by ELVM were being sanitized after
+// creation. Everything else was on its way out.
+func (server *ELVM) ResumeSanitization(ctx context.Context) {
+	for _, vg := range server.deviceClasses.get().getAllVolumeGroups() {
+		lvs, err := getCurrentLVs(ctx, vg)
+		if err != nil {
+			log.Println(
+				fmt.Sprintf(
+					"[WARN] Could not list logical volumes of '%s' to resume sanitizing: %s",
+					vg.Name,
+					err.Error(),
+				),
+			)
+			continue
+		}
+
+		for _, lv := range lvs {
+			policy, ok := getTagValue(lv.Tags, ELVM_SANITIZE_TAG_PREFIX)
+			if !ok {
+				continue
+			}
+
+			log.Println(
+				fmt.Sprintf(
+					"[INFO] Resuming sanitization of logical volume '%s'",
+					getVolumeId(lv),
+				),
+			)
+
+			server.sanitizer.start(lv, policy, !hasTag(lv.Tags, ELVM_TAG))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package elvm
+
+import (
+	"testing"
+
+	"github.com/google/lvmd/parser"
+)
+
+func TestGetRemovalSanitizePolicy(t *testing.T) {
+	classes := &deviceClasses{
+		classes: map[string]*deviceClass{
+			"fast": {
+				name: "fast",
+				volumeGroups: []*parser.VG{{Name: "vg-fast"}},
+				sanitize: SANITIZE_ZERO,
+				sanitizeOn: SANITIZE_ON_DELETE,
+			},
+			"scratch": {
+				name: "scratch",
+				volumeGroups: []*parser.VG{{Name: "vg-scratch"}},
+				sanitize: SANITIZE_WIPEFS,
+				sanitizeOn: SANITIZE_ON_CREATE,
+			},
+		},
+		defaultClass: "fast",
+	}
+
+	tests := []struct {
+		name string
+		lv *parser.LV
+		expected string
+	}{
+		{
+			name: "thick volume",
+			lv: &parser.LV{VGName: "vg-fast", Tags: []string{ELVM_TAG, ELVM_CLASS_TAG_PREFIX + "fast"}},
+			expected: SANITIZE_ZERO,
+		},
+		{
+			name: "thin volume",
+			lv: &parser.LV{
+				VGName: "vg-fast",
+				Tags: []string{ELVM_TAG, ELVM_CLASS_TAG_PREFIX + "fast"},
+				Attributes: parser.LVAttributes{Type: parser.VolumeTypeThin},
+			},
+			expected: SANITIZE_NONE,
+		},
+		{
+			name: "snapshot",
+			lv: &parser.LV{VGName: "vg-fast", Tags: []string{ELVM_SNAPSHOT_TAG, ELVM_CLASS_TAG_PREFIX + "fast"}},
+			expected: SANITIZE_NONE,
+		},
+		{
+			name: "class sanitizes on create",
+			lv: &parser.LV{VGName: "vg-scratch", Tags: []string{ELVM_TAG, ELVM_CLASS_TAG_PREFIX + "scratch"}},
+			expected: SANITIZE_NONE,
+		},
+		{
+			name: "class from volume group",
+			lv: &parser.LV{VGName: "vg-fast", Tags: []string{ELVM_TAG}},
+			expected: SANITIZE_ZERO,
+		},
+		{
+			name: "unknown volume group",
+			lv: &parser.LV{VGName: "vg-other", Tags: []string{ELVM_TAG}},
+			expected: SANITIZE_ZERO,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if policy := getRemovalSanitizePolicy(classes, test.lv); policy != test.expected {
+				t.Errorf("expected '%s', got '%s'", test.expected, policy)
+			}
+		})
+	}
+}
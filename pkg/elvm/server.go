@@ -1,5 +1,5 @@
 package elvm
 
-func NewELVMServer() ELVM {
-	return ELVM{}
+func NewELVMServer() *ELVM {
+	return &ELVM{}
 }
\ No newline at end of file
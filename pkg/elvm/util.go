@@ -5,14 +5,95 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/google/lvmd/commands"
 	"github.com/google/lvmd/parser"
 )
 
+func checkVolumeCapability(capability *csi.VolumeCapability, allowMultiNode bool) error {
+	if capability == nil || capability.AccessMode == nil {
+		return errors.New("Volume capability with an access mode must be provided.")
+	}
+
+	// Make sure that the access type is one that we can handle
+	if capability.GetBlock() == nil && capability.GetMount() == nil {
+		return errors.New("Volume capability must have an access type of either block or mount.")
+	}
+
+	if mount := capability.GetMount(); mount != nil && mount.FsType != "" && !isFsTypeSupported(mount.FsType) {
+		return errors.New(fmt.Sprintf("Unsupported fs type: %s. Must be one of %v", mount.FsType, SUPPORTED_FS_TYPES))
+	}
+
+	if !isAccessModeSupported(capability.AccessMode.Mode, allowMultiNode) {
+		return errors.New(fmt.Sprintf("Unsupported access mode: %s", capability.AccessMode.Mode))
+	}
+
+	return nil
+}
+
+// Only new volumes are held to the multi-node rule, so that existing volumes
+// with the legacy access mode can still be used after an upgrade
+func checkExistingVolumeCapability(capability *csi.VolumeCapability, allowMultiNode bool) error {
+	if capability != nil && capability.AccessMode != nil && capability.AccessMode.Mode == LEGACY_ACCESS_MODE {
+		allowMultiNode = true
+	}
+
+	return checkVolumeCapability(capability, allowMultiNode)
+}
+
+func isFsTypeSupported(fsType string) bool {
+	for _, supported := range SUPPORTED_FS_TYPES {
+		if fsType == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAccessModeSupported(mode csi.VolumeCapability_AccessMode_Mode, allowMultiNode bool) bool {
+	for _, supported := range SUPPORTED_ACCESS_MODES {
+		if mode == supported {
+			return true
+		}
+	}
+
+	if allowMultiNode {
+		for _, supported := range MULTI_NODE_ACCESS_MODES {
+			if mode == supported {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isReadOnlyAccessMode(capability *csi.VolumeCapability) bool {
+	mode := capability.GetAccessMode().GetMode()
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+func getNodeTopology(nodeId string) *csi.Topology {
+	return &csi.Topology{
+		Segments: map[string]string{
+			TOPOLOGY_KEY: nodeId,
+		},
+	}
+}
+
+func isTopologyForNode(topology *csi.Topology, nodeId string) bool {
+	node, ok := topology.Segments[TOPOLOGY_KEY]
+	return ok && node == nodeId
+}
+
 func getCurrentVG(ctx context.Context, volumeGroup *parser.VG) (*parser.VG, error) {
 	// Get all of the volume groups
 	vgs, err := commands.ListVG(ctx)
@@ -31,7 +112,7 @@ func getCurrentVG(ctx context.Context, volumeGroup *parser.VG) (*parser.VG, erro
 
 	// Make sure that we found the VG
 	if current == nil {
-		return nil, errors.New(fmt.Sprintf("Could not find requested VG '%s' in %s", volumeGroup, vgs))
+		return nil, errors.New(fmt.Sprintf("Could not find requested VG '%s' in %v", volumeGroup.Name, vgs))
 	}
 
 	// Return the result
@@ -51,6 +132,160 @@ func getCurrentLVs(ctx context.Context, volumeGroup *parser.VG) ([]*parser.LV, e
 	return lvs, nil
 }
 
+func findLogicalVolume(lvs []*parser.LV, name string) *parser.LV {
+	for _, lv := range lvs {
+		if lv.Name == name {
+			return lv
+		}
+	}
+
+	return nil
+}
+
+func hasTag(tags []string, wanted string) bool {
+	for _, tag := range tags {
+		if tag == wanted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the value of the first tag with the given prefix, if any
+func getTagValue(tags []string, prefix string) (string, bool) {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix), true
+		}
+	}
+
+	return "", false
+}
+
+// Pages through the volumes sorted by name, so that the ordering is stable.
+// Note: Tokens are the name of the first volume of the next page, so a token
+// whose volume has since been removed is stale.
+func getPage(lvs []*parser.LV, maxEntries int32, startingToken string) ([]*parser.LV, string, error) {
+	sort.Slice(lvs, func(i, j int) bool {
+		return getVolumeId(lvs[i]) < getVolumeId(lvs[j])
+	})
+
+	start := 0
+	if startingToken != "" {
+		start = -1
+		for i, lv := range lvs {
+			if getVolumeId(lv) == startingToken {
+				start = i
+				break
+			}
+		}
+
+		if start == -1 {
+			return nil, "", errors.New(fmt.Sprintf("Starting token '%s' is no longer valid", startingToken))
+		}
+	}
+
+	end := len(lvs)
+	if maxEntries > 0 && start + int(maxEntries) < len(lvs) {
+		end = start + int(maxEntries)
+	}
+
+	nextToken := ""
+	if end < len(lvs) {
+		nextToken = getVolumeId(lvs[end])
+	}
+
+	return lvs[start:end], nextToken, nil
+}
+
+// Note: LVM escapes - by doubling them
+func getDevicePath(logicalVolume *parser.LV) string {
+	return fmt.Sprintf(
+		"/dev/mapper/%s-%s",
+		strings.Replace(logicalVolume.VGName, "-", "--", -1),
+		strings.Replace(logicalVolume.Name, "-", "--", -1),
+	)
+}
+
+// lvmd does not expose the extent size of a volume group, so ask vgs directly
+func getExtentSize(ctx context.Context, volumeGroup *parser.VG) (uint64, error) {
+	args := []string {
+		"--units=b",
+		"--nosuffix",
+		"--noheadings",
+		"-o", "vg_extent_size",
+		volumeGroup.Name,
+	}
+
+	cmd := exec.CommandContext(ctx, "vgs", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	extentSize, err := strconv.ParseUint(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Could not parse extent size '%s' => %s", string(output), err))
+	}
+
+	return extentSize, nil
+}
+
+// LVM allocates whole extents, so round the capacity up to the nearest extent
+// without going past the max (if any) or what is available
+func alignToExtent(capacity uint64, extentSize uint64, min uint64, max uint64, available uint64) (uint64, error) {
+	if extentSize == 0 {
+		return capacity, nil
+	}
+
+	remainder := capacity % extentSize
+	if remainder == 0 {
+		return capacity, nil
+	}
+
+	alignedCapacity := capacity + extentSize - remainder
+	if (max != 0 && alignedCapacity > max) || alignedCapacity > available {
+		alignedCapacity = capacity - remainder
+	}
+
+	if alignedCapacity == 0 || alignedCapacity < min {
+		return 0, errors.New(
+			fmt.Sprintf(
+				"Could not create a valid size within constraints. Nearest multiples of the extent size (%d) are outside the requested range [%d, %d].",
+				extentSize,
+				min,
+				max,
+			),
+		)
+	}
+
+	return alignedCapacity, nil
+}
+
+func extendLogicalVolume(ctx context.Context, logicalVolume *parser.LV, capacity uint64) error {
+	command := "lvextend"
+
+	// Make sure that we have the needed command
+	if !isCommandAvailable(command) {
+		return errors.New("Could not find command in path: " + command)
+	}
+
+	args := []string {
+		"-L", fmt.Sprintf("%db", capacity),
+		fmt.Sprintf("%s/%s", logicalVolume.VGName, logicalVolume.Name),
+	}
+
+	// Make sure that the command ran correctly
+	cmd := exec.CommandContext(ctx, command, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	return nil
+}
+
 // LVM requires a multiple of the block size of 512, so make sure to do that here
 // TODO: Is it always 512? (Seems like it, atl least from lvmd's point of view)
 func getCapacity(available uint64, min uint64, max uint64) (uint64, error) {
@@ -97,6 +332,50 @@ func getCapacity(available uint64, min uint64, max uint64) (uint64, error) {
 	return alignedCapacity, nil
 }
 
+// Thin volumes only take up space in their pool as they are written to, so they
+// are made exactly as large as requested instead of using up everything that is
+// left to overprovision
+func getThinCapacity(available uint64, min uint64, max uint64) (uint64, error) {
+	capacity := min
+	if capacity == 0 {
+		capacity = max
+	}
+
+	if capacity == 0 {
+		return 0, errors.New("Thin volumes must be requested with a required or limit size.")
+	}
+
+	// Align the capacity up to 512, or down if that would go past the limit
+	if remainder := capacity % 512; remainder != 0 {
+		capacity += 512 - remainder
+		if max != 0 && capacity > max {
+			capacity -= 512
+		}
+	}
+
+	if capacity == 0 || capacity < min {
+		return 0, errors.New(
+			fmt.Sprintf(
+				"Could not create a valid size within constraints. Nearest multiples of 512 are outside the requested range [%d, %d].",
+				min,
+				max,
+			),
+		)
+	}
+
+	if capacity > available {
+		return 0, errors.New(
+			fmt.Sprintf(
+				"Could not create a valid size within constraints. Not enough available space (%d) to meet minimum requirements (%d).",
+				available,
+				capacity,
+			),
+		)
+	}
+
+	return capacity, nil
+}
+
 type LsblkResponse struct {
 	BlockDevices []VolumeInfo `json:"blockdevices"`
 }
@@ -107,6 +386,10 @@ type VolumeInfo struct {
 }
 
 func getVolumeInfo(logicalVolume *parser.LV) (*VolumeInfo, error) {
+	return getDeviceInfo(getDataDevicePath(logicalVolume))
+}
+
+func getDeviceInfo(device string) (*VolumeInfo, error) {
 	command := "lsblk"
 
 	// Make sure that we have the needed command
@@ -115,15 +398,10 @@ func getVolumeInfo(logicalVolume *parser.LV) (*VolumeInfo, error) {
 	}
 
 	// Set up the needed args
-	// Note: LVM escapes - by doubling them
 	args := []string {
 		"-o", "fstype,mountpoints",
 		"--json",
-		fmt.Sprintf(
-			"/dev/mapper/%s-%s",
-			logicalVolume.VGName,
-			strings.Replace(logicalVolume.Name, "-", "--", -1),
-		),
+		device,
 	}
 
 	// Make sure that the command ran correctly
@@ -133,16 +411,34 @@ func getVolumeInfo(logicalVolume *parser.LV) (*VolumeInfo, error) {
 		return nil, errors.New(fmt.Sprintf("%s => %s", string(output), err))
 	}
 
-	// Unmarshal the command output into a struct
+	return parseLsblkOutput(output)
+}
+
+// Note: lsblk reports an unmounted device as having a single null mount point,
+// so empty entries are dropped.
+func parseLsblkOutput(output []byte) (*VolumeInfo, error) {
 	var result LsblkResponse
 	if err := json.Unmarshal(output, &result); err != nil {
 		return nil, errors.New(fmt.Sprintf("Could not unmarshal lsblk => %s", err.Error()))
 	}
 
-	return &result.BlockDevices[0], nil
+	if len(result.BlockDevices) == 0 {
+		return nil, errors.New("lsblk did not report any block devices")
+	}
+
+	info := result.BlockDevices[0]
+	mountPoints := []string{}
+	for _, mountPoint := range info.MountPoints {
+		if mountPoint != "" {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+	info.MountPoints = mountPoints
+
+	return &info, nil
 }
 
-func formatLogicalVolume(logicalVolume *parser.LV, fsType string) error {
+func formatLogicalVolume(logicalVolume *parser.LV, fsType string, options []string) error {
 	command := "mkfs." + fsType
 
 	// Make sure that we have the needed command
@@ -151,14 +447,10 @@ func formatLogicalVolume(logicalVolume *parser.LV, fsType string) error {
 	}
 
 	// Get the path to the disk to format
-	disk := fmt.Sprintf(
-		"/dev/mapper/%s-%s",
-		logicalVolume.VGName,
-		strings.Replace(logicalVolume.Name, "-", "--", -1),
-	)
+	disk := getDataDevicePath(logicalVolume)
 
 	// Make sure that the command ran correctly
-	cmd := exec.Command(command, disk)
+	cmd := exec.Command(command, append(append([]string{}, options...), disk)...)
 	output, err := cmd.Output()
 	if err != nil {
 		return errors.New(fmt.Sprintf("%s => %s", string(output), err))
@@ -167,6 +459,418 @@ func formatLogicalVolume(logicalVolume *parser.LV, fsType string) error {
 	return nil
 }
 
+// The COW size is either a number of bytes or a percentage of the origin volume.
+// Note: Defaults to the full size of the origin, so that the snapshot can never
+// be invalidated by running out of space.
+func getSnapshotCowSize(origin *parser.LV, parameter string) (uint64, error) {
+	var size uint64
+	if parameter == "" {
+		size = origin.Size
+	} else if strings.HasSuffix(parameter, "%") {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(parameter, "%"), 10, 64)
+		if err != nil || percent == 0 || percent > 100 {
+			return 0, errors.New(fmt.Sprintf("Invalid COW percentage '%s'. Must be in the range [1%%, 100%%].", parameter))
+		}
+
+		size = origin.Size * percent / 100
+	} else {
+		bytes, err := strconv.ParseUint(parameter, 10, 64)
+		if err != nil || bytes == 0 {
+			return 0, errors.New(fmt.Sprintf("Invalid COW size '%s'. Must be a positive number of bytes or a percentage.", parameter))
+		}
+
+		size = bytes
+	}
+
+	// Align the size to 512, never going below a single block
+	size = size - size % 512
+	if size == 0 {
+		size = 512
+	}
+
+	return size, nil
+}
+
+// Parses a size in bytes, optionally with a decimal (k, M, G, T) or binary (Ki,
+// Mi, Gi, Ti) suffix
+func parseSize(value string) (uint64, error) {
+	suffixes := []struct {
+		suffix string
+		multiplier uint64
+	}{
+		{"Ki", 1 << 10},
+		{"Mi", 1 << 20},
+		{"Gi", 1 << 30},
+		{"Ti", 1 << 40},
+		{"k", 1000},
+		{"M", 1000 * 1000},
+		{"G", 1000 * 1000 * 1000},
+		{"T", 1000 * 1000 * 1000 * 1000},
+	}
+
+	multiplier := uint64(1)
+	number := value
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(value, suffix.suffix) {
+			multiplier = suffix.multiplier
+			number = strings.TrimSuffix(value, suffix.suffix)
+			break
+		}
+	}
+
+	size, err := strconv.ParseUint(number, 10, 64)
+	if err != nil || size == 0 || size > ^uint64(0) / multiplier {
+		return 0, errors.New(fmt.Sprintf("Invalid size '%s'. Must be a positive number of bytes, optionally with a suffix like Gi.", value))
+	}
+
+	return size * multiplier, nil
+}
+
+// How big the origin was when the snapshot was taken, which is all that a restore
+// needs to fit
+// Note: Thin snapshots are the size of their origin anyway. Thick snapshots from
+// before the size was recorded only know the size of their COW area.
+func getSnapshotOriginSize(snapshot *parser.LV) uint64 {
+	if value, ok := getTagValue(snapshot.Tags, ELVM_ORIGIN_SIZE_TAG_PREFIX); ok {
+		if size, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return size
+		}
+	}
+
+	return snapshot.Size
+}
+
+func createSnapshot(ctx context.Context, origin *parser.LV, name string, cowSize uint64, tags []string) error {
+	command := "lvcreate"
+
+	// Make sure that we have the needed command
+	if !isCommandAvailable(command) {
+		return errors.New("Could not find command in path: " + command)
+	}
+
+	// Thin snapshots share the pool of their origin, so they need no COW space
+	args := []string {
+		"-s",
+		"-n", name,
+	}
+	if origin.Attributes.Type != parser.VolumeTypeThin {
+		args = append(args, "-L", fmt.Sprintf("%db", cowSize))
+	}
+	for _, tag := range tags {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, fmt.Sprintf("%s/%s", origin.VGName, origin.Name))
+
+	// Make sure that the command ran correctly
+	cmd := exec.CommandContext(ctx, command, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	return nil
+}
+
+// A volume group without the requested thin pool is a problem with the request,
+// unlike a failure to ask LVM about it
+type thinPoolNotFoundError struct {
+	thinPool string
+	volumeGroup string
+}
+
+func (e *thinPoolNotFoundError) Error() string {
+	return fmt.Sprintf("Could not find thin pool '%s' in volume group '%s'", e.thinPool, e.volumeGroup)
+}
+
+// lvmd does not know about thin pools, so ask lvs directly for the size of the
+// pool and the total virtual size of every thin volume inside of it
+func getThinPoolUsage(ctx context.Context, volumeGroup *parser.VG, thinPool string) (uint64, uint64, error) {
+	separator := "<:SEP:>"
+	args := []string {
+		"--units=b",
+		"--nosuffix",
+		"--noheadings",
+		"--separator=" + separator,
+		"-o", "lv_name,lv_size,pool_lv,lv_attr",
+		volumeGroup.Name,
+	}
+
+	cmd := exec.CommandContext(ctx, "lvs", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	poolFound := false
+	var poolSize, provisioned uint64
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), separator)
+		if len(fields) != 4 {
+			continue
+		}
+
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, errors.New(fmt.Sprintf("Could not parse size of '%s' => %s", fields[0], err))
+		}
+
+		if fields[0] == thinPool && strings.HasPrefix(fields[3], string(parser.VolumeTypeThinPool)) {
+			poolFound = true
+			poolSize = size
+		} else if fields[2] == thinPool {
+			provisioned += size
+		}
+	}
+
+	if !poolFound {
+		return 0, 0, &thinPoolNotFoundError{thinPool: thinPool, volumeGroup: volumeGroup.Name}
+	}
+
+	return poolSize, provisioned, nil
+}
+
+// The space available in a thin pool is its real size scaled by how much we
+// are willing to overcommit, minus what has already been handed out
+func getThinPoolAvailable(ctx context.Context, volumeGroup *parser.VG, thinPool string, overprovisionRatio float64) (uint64, error) {
+	poolSize, provisioned, err := getThinPoolUsage(ctx, volumeGroup, thinPool)
+	if err != nil {
+		return 0, err
+	}
+
+	allowed := uint64(float64(poolSize) * overprovisionRatio)
+	if provisioned >= allowed {
+		return 0, nil
+	}
+
+	return allowed - provisioned, nil
+}
+
+// Note: LVM picks the stripe size itself when it is 0
+func createStripedLogicalVolume(ctx context.Context, volumeGroup string, name string, size uint64, stripes uint32, stripeSize uint64, tags []string) (string, error) {
+	args := []string {
+		"-v",
+		"-n", name,
+		"-L", fmt.Sprintf("%db", size),
+		"-i", fmt.Sprintf("%d", stripes),
+	}
+	if stripeSize != 0 {
+		args = append(args, "-I", fmt.Sprintf("%db", stripeSize))
+	}
+	for _, tag := range tags {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, volumeGroup)
+
+	cmd := exec.CommandContext(ctx, "lvcreate", args...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// Adds and removes tags in a single step, so that a volume is never seen with
+// only half of the change
+func retagLogicalVolume(ctx context.Context, logicalVolume *parser.LV, add []string, remove []string) (string, error) {
+	args := []string{}
+	for _, tag := range add {
+		args = append(args, "--addtag", tag)
+	}
+	for _, tag := range remove {
+		args = append(args, "--deltag", tag)
+	}
+	args = append(args, logicalVolume.VGName + "/" + logicalVolume.Name)
+
+	cmd := exec.CommandContext(ctx, "lvchange", args...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func createThinLogicalVolume(ctx context.Context, volumeGroup string, thinPool string, name string, size uint64, tags []string) (string, error) {
+	args := []string {
+		"-v",
+		"-n", name,
+		"-V", fmt.Sprintf("%db", size),
+		"--thinpool", thinPool,
+	}
+	for _, tag := range tags {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, volumeGroup)
+
+	cmd := exec.CommandContext(ctx, "lvcreate", args...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// Creates a writable thin snapshot of a thin volume, which shares all of its
+// blocks with the source until they are written to
+func createThinSnapshotVolume(ctx context.Context, source *parser.LV, name string, tags []string) (string, error) {
+	// Note: Thin snapshots skip activation by default, so turn that off
+	args := []string {
+		"-v",
+		"-s",
+		"-kn",
+		"-n", name,
+	}
+	for _, tag := range tags {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, fmt.Sprintf("%s/%s", source.VGName, source.Name))
+
+	cmd := exec.CommandContext(ctx, "lvcreate", args...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// Copies the contents of one volume onto another, block for block
+func copyLogicalVolume(ctx context.Context, source *parser.LV, target *parser.LV) error {
+	command := "dd"
+
+	// Make sure that we have the needed command
+	if !isCommandAvailable(command) {
+		return errors.New("Could not find command in path: " + command)
+	}
+
+	args := []string {
+		"if=" + getDevicePath(source),
+		"of=" + getDevicePath(target),
+		"bs=4M",
+		"conv=fsync",
+		"status=none",
+	}
+
+	// Make sure that the command ran correctly
+	cmd := exec.CommandContext(ctx, command, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	return nil
+}
+
+func growFilesystem(logicalVolume *parser.LV, fsType string, mountPoint string) error {
+	// Each filesystem has its own way of growing while online
+	var command string
+	var args []string
+	switch {
+	case fsType == "xfs":
+		command = "xfs_growfs"
+		args = []string{mountPoint}
+	case strings.HasPrefix(fsType, "ext"):
+		command = "resize2fs"
+		args = []string{getDataDevicePath(logicalVolume)}
+	case fsType == "btrfs":
+		command = "btrfs"
+		args = []string{"filesystem", "resize", "max", mountPoint}
+	default:
+		return errors.New("Unsupported filesystem for online expansion: " + fsType)
+	}
+
+	// Make sure that we have the needed command
+	if !isCommandAvailable(command) {
+		return errors.New("Could not find command in path: " + command)
+	}
+
+	// Make sure that the command ran correctly
+	cmd := exec.Command(command, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s => %s", string(output), err))
+	}
+
+	return nil
+}
+
+// lvmd does not define the health bits that are specific to thin pools, so
+// do so here
+const (
+	volumeHealthFailed parser.VolumeHealth = 'F'
+	volumeHealthOutOfDataSpace parser.VolumeHealth = 'D'
+	volumeHealthMetadataReadOnly parser.VolumeHealth = 'M'
+)
+
+func checkLogicalVolumeHealth(logicalVolume *parser.LV) error {
+	switch logicalVolume.Attributes.Health {
+	case parser.VolumeHealthPartial:
+		return errors.New(fmt.Sprintf("Logical volume '%s' is partial. One or more PVs are missing.", logicalVolume.Name))
+	case volumeHealthFailed:
+		return errors.New(fmt.Sprintf("Logical volume '%s' has failed.", logicalVolume.Name))
+	case parser.VolumeHealthRefreshNeeded:
+		return errors.New(fmt.Sprintf("Logical volume '%s' needs to be refreshed.", logicalVolume.Name))
+	case parser.VolumeHealthMismatchesExist:
+		return errors.New(fmt.Sprintf("Logical volume '%s' has mismatches.", logicalVolume.Name))
+	}
+
+	switch logicalVolume.Attributes.State {
+	case parser.VolumeStateInvalidSnapshot, parser.VolumeStateInvalidSuspendedSnapshot:
+		return errors.New(fmt.Sprintf("Logical volume '%s' is an invalidated snapshot.", logicalVolume.Name))
+	}
+
+	return nil
+}
+
+func checkThinPoolHealth(thinPool *parser.LV) error {
+	switch thinPool.Attributes.Health {
+	case volumeHealthOutOfDataSpace:
+		return errors.New(fmt.Sprintf("Thin pool '%s' is out of data space.", thinPool.Name))
+	case volumeHealthMetadataReadOnly:
+		return errors.New(fmt.Sprintf("Thin pool '%s' has read-only metadata. It might be out of metadata space.", thinPool.Name))
+	}
+
+	return checkLogicalVolumeHealth(thinPool)
+}
+
+// Build the condition of a volume from what LVM knows about it, using the
+// rest of the volumes in the VG to check its thin pool and snapshots
+func getVolumeCondition(logicalVolume *parser.LV, lvs []*parser.LV) *csi.VolumeCondition {
+	abnormal := func(err error) *csi.VolumeCondition {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message: err.Error(),
+		}
+	}
+
+	if err := checkLogicalVolumeHealth(logicalVolume); err != nil {
+		return abnormal(err)
+	}
+
+	// Only volumes in the same volume group can be related
+	siblings := []*parser.LV{}
+	for _, lv := range lvs {
+		if lv.VGName == logicalVolume.VGName {
+			siblings = append(siblings, lv)
+		}
+	}
+
+	// Thin volumes are only as healthy as their pool
+	if poolName, ok := getTagValue(logicalVolume.Tags, ELVM_POOL_TAG_PREFIX); ok {
+		thinPool := findLogicalVolume(siblings, poolName)
+		if thinPool == nil {
+			return abnormal(errors.New(fmt.Sprintf("Could not find thin pool '%s'.", poolName)))
+		}
+
+		if err := checkThinPoolHealth(thinPool); err != nil {
+			return abnormal(err)
+		}
+	}
+
+	// Snapshots that have overflowed are useless, so report them on their origin
+	for _, lv := range siblings {
+		source, ok := getTagValue(lv.Tags, ELVM_SOURCE_TAG_PREFIX)
+		if !ok || source != logicalVolume.Name || !hasTag(lv.Tags, ELVM_SNAPSHOT_TAG) {
+			continue
+		}
+
+		if err := checkLogicalVolumeHealth(lv); err != nil {
+			return abnormal(err)
+		}
+	}
+
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message: "Volume is healthy",
+	}
+}
+
 func isCommandAvailable(name string) bool {
 	cmd := exec.Command("/bin/sh", "-c", "command -v " + name)
 	err := cmd.Run()
@@ -176,19 +880,86 @@ func isCommandAvailable(name string) bool {
 }
 
 func mountLogicalVolume(logicalVolume *parser.LV, mountFlags []string, target string, fsType string) error {
-	source := fmt.Sprintf(
-		"/dev/mapper/%s-%s",
-		logicalVolume.VGName,
-		strings.Replace(logicalVolume.Name, "-", "--", -1),
-	)
+	source := getDataDevicePath(logicalVolume)
+	flags, data := parseMountOptions(mountFlags)
+
+	return syscall.Mount(source, target, fsType, flags, data)
+}
+
+// Generic mount options that the kernel takes as flags instead of as data
+var MOUNT_OPTION_FLAGS = map[string]uintptr{
+	"dirsync": syscall.MS_DIRSYNC,
+	"noatime": syscall.MS_NOATIME,
+	"nodev": syscall.MS_NODEV,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"noexec": syscall.MS_NOEXEC,
+	"nosuid": syscall.MS_NOSUID,
+	"ro": syscall.MS_RDONLY,
+	"relatime": syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"sync": syscall.MS_SYNCHRONOUS,
+}
+
+// Splits mount options into kernel flags and the fs-specific data string
+// Note: Options that only reset a flag to its default, like rw, are dropped.
+func parseMountOptions(options []string) (uintptr, string) {
+	var flags uintptr
+	data := []string{}
+	for _, option := range options {
+		if flag, ok := MOUNT_OPTION_FLAGS[option]; ok {
+			flags |= flag
+			continue
+		}
 
-	return syscall.Mount(source, target, fsType, 0, "")
+		switch option {
+		case "", "defaults", "rw", "atime", "diratime", "dev", "exec", "suid", "async":
+			continue
+		}
+
+		data = append(data, option)
+	}
+
+	return flags, strings.Join(data, ",")
 }
 
 func unmountLogicalVolume(target string) error {
 	return syscall.Unmount(target, 0)
 }
 
+// Checks the mount table directly, since lsblk does not report bind mounts of
+// device nodes (as used for block volumes)
+func isMountPoint(target string) (bool, error) {
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+
+	// Note: Special characters in the mount point are octal escaped
+	unescape := strings.NewReplacer("\\040", " ", "\\011", "\t", "\\012", "\n", "\\134", "\\")
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		if unescape.Replace(fields[4]) == target {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func bindBlockDevice(logicalVolume *parser.LV, target string) error {
+	// Bind mount the device node to the target
+	return syscall.Mount(getDataDevicePath(logicalVolume), target, "", syscall.MS_BIND, "")
+}
+
+// Bind mounts cannot be made read-only directly, so remount them afterwards
+func remountReadOnly(target string) error {
+	return syscall.Mount("", target, "", syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY, "")
+}
+
 func bindLogicalVolume(logicalVolume *parser.LV, staging string, target string) error {
 	// Bind mount the staging path to the target
 	return syscall.Mount(staging, target, "", syscall.MS_BIND, "")
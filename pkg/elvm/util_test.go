@@ -0,0 +1,439 @@
+package elvm
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/lvmd/parser"
+)
+
+func TestParseLsblkOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		output string
+		fsType string
+		mountPoints []string
+		fails bool
+	}{
+		{
+			name: "unmounted",
+			output: `{"blockdevices": [{"fstype": "xfs", "mountpoints": [null]}]}`,
+			fsType: "xfs",
+			mountPoints: []string{},
+		},
+		{
+			name: "unformatted",
+			output: `{"blockdevices": [{"fstype": null, "mountpoints": [null]}]}`,
+			fsType: "",
+			mountPoints: []string{},
+		},
+		{
+			name: "mounted twice",
+			output: `{"blockdevices": [{"fstype": "ext4", "mountpoints": ["/staging", "/target"]}]}`,
+			fsType: "ext4",
+			mountPoints: []string{"/staging", "/target"},
+		},
+		{
+			name: "no devices",
+			output: `{"blockdevices": []}`,
+			fails: true,
+		},
+		{
+			name: "not json",
+			output: `lsblk: /dev/missing: not a block device`,
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := parseLsblkOutput([]byte(test.output))
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", info)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if info.FsType != test.fsType {
+				t.Errorf("fs type: expected '%s', got '%s'", test.fsType, info.FsType)
+			}
+
+			if !reflect.DeepEqual(info.MountPoints, test.mountPoints) {
+				t.Errorf("mount points: expected %v, got %v", test.mountPoints, info.MountPoints)
+			}
+		})
+	}
+}
+
+func TestGetSnapshotCowSize(t *testing.T) {
+	origin := &parser.LV{Size: 10 * 1024 * 1024}
+
+	tests := []struct {
+		name string
+		parameter string
+		expected uint64
+		fails bool
+	}{
+		{name: "default", parameter: "", expected: 10 * 1024 * 1024},
+		{name: "percentage", parameter: "50%", expected: 5 * 1024 * 1024},
+		{name: "bytes", parameter: "4096", expected: 4096},
+		{name: "aligned down", parameter: "1000", expected: 512},
+		{name: "never empty", parameter: "100", expected: 512},
+		{name: "zero percent", parameter: "0%", fails: true},
+		{name: "over a hundred percent", parameter: "101%", fails: true},
+		{name: "zero bytes", parameter: "0", fails: true},
+		{name: "not a number", parameter: "lots", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			size, err := getSnapshotCowSize(origin, test.parameter)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got size %d", size)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if size != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, size)
+			}
+		})
+	}
+}
+
+func TestGetSnapshotOriginSize(t *testing.T) {
+	tests := []struct {
+		name string
+		snapshot *parser.LV
+		expected uint64
+	}{
+		{
+			name: "recorded",
+			snapshot: &parser.LV{Size: 4096, Tags: []string{ELVM_SNAPSHOT_TAG, ELVM_ORIGIN_SIZE_TAG_PREFIX + "1048576"}},
+			expected: 1048576,
+		},
+		{
+			name: "not recorded",
+			snapshot: &parser.LV{Size: 4096, Tags: []string{ELVM_SNAPSHOT_TAG}},
+			expected: 4096,
+		},
+		{
+			name: "not a number",
+			snapshot: &parser.LV{Size: 4096, Tags: []string{ELVM_ORIGIN_SIZE_TAG_PREFIX + "big"}},
+			expected: 4096,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if size := getSnapshotOriginSize(test.snapshot); size != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, size)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		name string
+		value string
+		expected uint64
+		fails bool
+	}{
+		{name: "bytes", value: "4096", expected: 4096},
+		{name: "decimal", value: "2k", expected: 2000},
+		{name: "binary", value: "2Ki", expected: 2048},
+		{name: "gibibytes", value: "1Gi", expected: 1 << 30},
+		{name: "terabytes", value: "3T", expected: 3 * 1000 * 1000 * 1000 * 1000},
+		{name: "zero", value: "0", fails: true},
+		{name: "empty", value: "", fails: true},
+		{name: "negative", value: "-1Gi", fails: true},
+		{name: "fraction", value: "1.5Gi", fails: true},
+		{name: "unknown suffix", value: "1Pi", fails: true},
+		{name: "overflow", value: "20000000Ti", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			size, err := parseSize(test.value)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got size %d", size)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if size != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, size)
+			}
+		})
+	}
+}
+
+func TestCheckVolumeCapability(t *testing.T) {
+	singleWriter := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}
+	multiWriter := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER}
+	multiReader := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}
+	legacy := &csi.VolumeCapability_AccessMode{Mode: LEGACY_ACCESS_MODE}
+	block := &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	mount := func(fsType string) *csi.VolumeCapability_Mount {
+		return &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}}
+	}
+
+	tests := []struct {
+		name string
+		capability *csi.VolumeCapability
+		allowMultiNode bool
+		existing bool
+		fails bool
+	}{
+		{
+			name: "block",
+			capability: &csi.VolumeCapability{AccessType: block, AccessMode: singleWriter},
+		},
+		{
+			name: "mount",
+			capability: &csi.VolumeCapability{AccessType: mount("xfs"), AccessMode: singleWriter},
+		},
+		{
+			name: "mount with default fs type",
+			capability: &csi.VolumeCapability{AccessType: mount(""), AccessMode: singleWriter},
+		},
+		{
+			name: "unsupported fs type",
+			capability: &csi.VolumeCapability{AccessType: mount("ntfs"), AccessMode: singleWriter},
+			fails: true,
+		},
+		{
+			name: "no access type",
+			capability: &csi.VolumeCapability{AccessMode: singleWriter},
+			fails: true,
+		},
+		{
+			name: "no access mode",
+			capability: &csi.VolumeCapability{AccessType: block},
+			fails: true,
+		},
+		{
+			name: "missing",
+			fails: true,
+		},
+		{
+			name: "multi node",
+			capability: &csi.VolumeCapability{AccessType: block, AccessMode: multiWriter},
+			fails: true,
+		},
+		{
+			name: "legacy multi node",
+			capability: &csi.VolumeCapability{AccessType: block, AccessMode: legacy},
+			fails: true,
+		},
+		{
+			name: "legacy multi node on existing volume",
+			capability: &csi.VolumeCapability{AccessType: block, AccessMode: legacy},
+			existing: true,
+		},
+		{
+			name: "multi node on existing volume",
+			capability: &csi.VolumeCapability{AccessType: block, AccessMode: multiReader},
+			existing: true,
+			fails: true,
+		},
+		{
+			name: "multi node allowed",
+			capability: &csi.VolumeCapability{AccessType: block, AccessMode: multiWriter},
+			allowMultiNode: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := checkVolumeCapability
+			if test.existing {
+				check = checkExistingVolumeCapability
+			}
+
+			err := check(test.capability, test.allowMultiNode)
+			if test.fails && err == nil {
+				t.Errorf("expected an error")
+			}
+
+			if !test.fails && err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestGetTagValue(t *testing.T) {
+	tags := []string{
+		ELVM_SNAPSHOT_TAG,
+		ELVM_NAME_TAG_PREFIX + "snapshot-1",
+		ELVM_SOURCE_TAG_PREFIX + "volume-1",
+		ELVM_SOURCE_TAG_PREFIX + "volume-2",
+		ELVM_POOL_TAG_PREFIX,
+	}
+
+	tests := []struct {
+		name string
+		prefix string
+		expected string
+		found bool
+	}{
+		{name: "present", prefix: ELVM_NAME_TAG_PREFIX, expected: "snapshot-1", found: true},
+		{name: "first of several", prefix: ELVM_SOURCE_TAG_PREFIX, expected: "volume-1", found: true},
+		{name: "empty value", prefix: ELVM_POOL_TAG_PREFIX, expected: "", found: true},
+		{name: "missing", prefix: ELVM_CREATED_TAG_PREFIX, expected: "", found: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, found := getTagValue(tags, test.prefix)
+			if found != test.found {
+				t.Fatalf("expected found to be %t, got %t", test.found, found)
+			}
+
+			if value != test.expected {
+				t.Errorf("expected '%s', got '%s'", test.expected, value)
+			}
+		})
+	}
+
+	// Flags only ever match exactly
+	if !hasTag(tags, ELVM_SNAPSHOT_TAG) {
+		t.Errorf("expected to find '%s'", ELVM_SNAPSHOT_TAG)
+	}
+	if hasTag(tags, ELVM_TAG) || hasTag(tags, ELVM_NAME_TAG_PREFIX) {
+		t.Errorf("expected a prefix to not count as a tag")
+	}
+}
+
+func TestAlignToExtent(t *testing.T) {
+	const mebibyte = 1 << 20
+	const extent = 4 * mebibyte
+
+	tests := []struct {
+		name string
+		capacity uint64
+		extentSize uint64
+		min uint64
+		max uint64
+		available uint64
+		expected uint64
+		fails bool
+	}{
+		{name: "unknown extent size", capacity: 5 * mebibyte, extentSize: 0, available: 100 * mebibyte, expected: 5 * mebibyte},
+		{name: "aligned", capacity: 8 * mebibyte, extentSize: extent, available: 100 * mebibyte, expected: 8 * mebibyte},
+		{name: "round up", capacity: 5 * mebibyte, extentSize: extent, available: 100 * mebibyte, expected: 8 * mebibyte},
+		{name: "round down for max", capacity: 5 * mebibyte, extentSize: extent, min: mebibyte, max: 6 * mebibyte, available: 100 * mebibyte, expected: 4 * mebibyte},
+		{name: "round down for available", capacity: 5 * mebibyte, extentSize: extent, available: 6 * mebibyte, expected: 4 * mebibyte},
+		{name: "below min", capacity: 5 * mebibyte, extentSize: extent, min: 5 * mebibyte, max: 6 * mebibyte, available: 100 * mebibyte, fails: true},
+		{name: "smaller than an extent", capacity: mebibyte, extentSize: extent, available: 2 * mebibyte, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			capacity, err := alignToExtent(test.capacity, test.extentSize, test.min, test.max, test.available)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got capacity %d", capacity)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if capacity != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, capacity)
+			}
+		})
+	}
+}
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		options []string
+		flags uintptr
+		data string
+	}{
+		{name: "none", options: nil, flags: 0, data: ""},
+		{name: "flags", options: []string{"ro", "noatime"}, flags: syscall.MS_RDONLY | syscall.MS_NOATIME, data: ""},
+		{name: "defaults dropped", options: []string{"defaults", "rw", "", "exec"}, flags: 0, data: ""},
+		{name: "fs specific", options: []string{"discard", "nouuid"}, flags: 0, data: "discard,nouuid"},
+		{name: "mixed", options: []string{"nosuid", "discard", "rw", "nodev", "commit=30"}, flags: syscall.MS_NOSUID | syscall.MS_NODEV, data: "discard,commit=30"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags, data := parseMountOptions(test.options)
+			if flags != test.flags {
+				t.Errorf("flags: expected %#x, got %#x", test.flags, flags)
+			}
+
+			if data != test.data {
+				t.Errorf("data: expected '%s', got '%s'", test.data, data)
+			}
+		})
+	}
+}
+
+func TestGetThinCapacity(t *testing.T) {
+	const gibibyte = 1 << 30
+
+	tests := []struct {
+		name string
+		available uint64
+		min uint64
+		max uint64
+		expected uint64
+		fails bool
+	}{
+		{name: "no limit", available: 100 * gibibyte, min: gibibyte, max: 0, expected: gibibyte},
+		{name: "within limit", available: 100 * gibibyte, min: gibibyte, max: 2 * gibibyte, expected: gibibyte},
+		{name: "round up", available: 100 * gibibyte, min: 1000, max: 0, expected: 1024},
+		{name: "round down for limit", available: 100 * gibibyte, min: 0, max: 1000, expected: 512},
+		{name: "only limit", available: 100 * gibibyte, min: 0, max: gibibyte, expected: gibibyte},
+		{name: "no size", available: 100 * gibibyte, fails: true},
+		{name: "limit below a block", available: 100 * gibibyte, min: 0, max: 100, fails: true},
+		{name: "not enough space", available: gibibyte, min: 2 * gibibyte, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			capacity, err := getThinCapacity(test.available, test.min, test.max)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got capacity %d", capacity)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if capacity != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, capacity)
+			}
+		})
+	}
+}